@@ -0,0 +1,237 @@
+package httpcache
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxDeltaSeconds is the value that delta-seconds too large to represent are clamped
+// to, as suggested by RFC 9111, section 1.2.2.
+const maxDeltaSeconds = 1 << 31
+
+// CacheControl holds the directives of one or more Cache-Control header fields,
+// keyed by lower-cased directive name. Directives without an argument map to the
+// empty string and quoted-string arguments are stored unquoted.
+type CacheControl map[string]string
+
+// ParseCacheControl parses every Cache-Control field in headers as described in
+// RFC 9111, section 5.2.
+//
+// Directive names are case-insensitive and quoted-string arguments may contain
+// commas, so no-cache="Set-Cookie, X-Foo" is a single directive. When a directive
+// appears more than once the most restrictive occurrence wins: the smallest
+// max-age, s-maxage, max-stale, stale-if-error and stale-while-revalidate, and the
+// largest min-fresh. For no-cache and private an unqualified occurrence overrides
+// any field-name list, and field-name lists are otherwise merged. For all other
+// directives the first occurrence is used.
+func ParseCacheControl(headers http.Header) CacheControl {
+	cc := CacheControl{}
+	for _, field := range headers[http.CanonicalHeaderKey("Cache-Control")] {
+		p := ccParser{s: field}
+		for {
+			name, value, ok := p.next()
+			if !ok {
+				break
+			}
+			cc.merge(name, value)
+		}
+	}
+	return cc
+}
+
+// effectiveCacheControl returns the Cache-Control directives that apply to a message
+// with headers. Following RFC 9111, section 5.4, Pragma: no-cache counts as
+// Cache-Control: no-cache when there is no Cache-Control field. Pragma has no defined
+// meaning in responses, but HTTP/1.0 origins send it there with the same intent, and
+// honouring it can only cause extra revalidation.
+func effectiveCacheControl(headers http.Header) CacheControl {
+	cc := ParseCacheControl(headers)
+	if _, ok := headers["Cache-Control"]; !ok {
+		for _, pragma := range headerAllCommaSepValues(headers, "Pragma") {
+			if strings.EqualFold(pragma, "no-cache") {
+				cc["no-cache"] = ""
+			}
+		}
+	}
+	return cc
+}
+
+// Has reports whether the directive name is present.
+func (cc CacheControl) Has(name string) bool {
+	_, ok := cc[strings.ToLower(name)]
+	return ok
+}
+
+// Get returns the argument of the directive name and whether it is present.
+func (cc CacheControl) Get(name string) (value string, ok bool) {
+	value, ok = cc[strings.ToLower(name)]
+	return
+}
+
+// Duration returns the delta-seconds argument of the directive name, such as max-age.
+// ok is false if the directive is absent or its argument isn't valid delta-seconds.
+func (cc CacheControl) Duration(name string) (d time.Duration, ok bool) {
+	value, ok := cc[strings.ToLower(name)]
+	if !ok {
+		return 0, false
+	}
+	return parseDeltaSeconds(value)
+}
+
+// FieldNames returns the canonicalized header names listed in the argument of a
+// qualified directive such as no-cache="Set-Cookie" or private="Authorization".
+// It returns nil if the directive is absent or has no argument.
+func (cc CacheControl) FieldNames(name string) []string {
+	value := cc[strings.ToLower(name)]
+	if value == "" {
+		return nil
+	}
+	var names []string
+	for _, f := range strings.Split(value, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			names = append(names, http.CanonicalHeaderKey(f))
+		}
+	}
+	return names
+}
+
+// merge records directive name with value, resolving duplicates in favour of
+// the most restrictive occurrence.
+func (cc CacheControl) merge(name, value string) {
+	prev, dup := cc[name]
+	if !dup {
+		cc[name] = value
+		return
+	}
+	switch name {
+	case "max-age", "s-maxage", "max-stale", "stale-if-error", "stale-while-revalidate":
+		cc[name] = restrictiveDelta(prev, value, false)
+	case "min-fresh":
+		cc[name] = restrictiveDelta(prev, value, true)
+	case "no-cache", "private":
+		if prev == "" || value == "" {
+			cc[name] = ""
+		} else {
+			cc[name] = prev + ", " + value
+		}
+	}
+}
+
+// restrictiveDelta picks the more restrictive of two delta-seconds arguments. A
+// bare directive (such as max-stale) places no limit, so any number beats it. An
+// unparseable argument is treated as the most restrictive value, since callers
+// treat it as zero.
+func restrictiveDelta(a, b string, larger bool) string {
+	if a == "" {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	x, okA := parseDeltaSeconds(a)
+	y, okB := parseDeltaSeconds(b)
+	switch {
+	case !okA:
+		return a
+	case !okB:
+		return b
+	case (y > x) == larger:
+		return b
+	}
+	return a
+}
+
+// parseDeltaSeconds parses a delta-seconds value (RFC 9111, section 1.2.2), which
+// consists of digits only: signs, fractions and exponents make it invalid, and ok is
+// false with a zero duration. Values above 2^31 seconds are clamped rather than
+// overflowing.
+func parseDeltaSeconds(value string) (d time.Duration, ok bool) {
+	if value == "" {
+		return 0, false
+	}
+	var seconds int64
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		if seconds < maxDeltaSeconds {
+			seconds = seconds*10 + int64(c-'0')
+		}
+	}
+	if seconds > maxDeltaSeconds {
+		seconds = maxDeltaSeconds
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// ccParser tokenizes a single Cache-Control field value.
+type ccParser struct {
+	s string
+	i int
+}
+
+// next returns the next directive in the field, with its name lower-cased and
+// its argument unquoted. Malformed input is skipped up to the next comma.
+func (p *ccParser) next() (name, value string, ok bool) {
+	for {
+		p.skip(" \t,")
+		if p.i >= len(p.s) {
+			return "", "", false
+		}
+		name = strings.ToLower(p.token())
+		p.skip(" \t")
+		value = ""
+		if p.i < len(p.s) && p.s[p.i] == '=' {
+			p.i++
+			p.skip(" \t")
+			if p.i < len(p.s) && p.s[p.i] == '"' {
+				value = p.quoted()
+			} else {
+				value = p.token()
+			}
+		}
+		// Discard anything between the directive and the next comma.
+		for p.i < len(p.s) && p.s[p.i] != ',' {
+			p.i++
+		}
+		if name != "" {
+			return name, value, true
+		}
+	}
+}
+
+func (p *ccParser) skip(chars string) {
+	for p.i < len(p.s) && strings.IndexByte(chars, p.s[p.i]) >= 0 {
+		p.i++
+	}
+}
+
+func (p *ccParser) token() string {
+	start := p.i
+	for p.i < len(p.s) && strings.IndexByte("=, \t\"", p.s[p.i]) < 0 {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+// quoted reads a quoted-string starting at the opening quote, resolving
+// quoted-pairs. An unterminated string runs to the end of the field.
+func (p *ccParser) quoted() string {
+	var b strings.Builder
+	for p.i++; p.i < len(p.s); p.i++ {
+		c := p.s[p.i]
+		switch {
+		case c == '"':
+			p.i++
+			return b.String()
+		case c == '\\' && p.i+1 < len(p.s):
+			p.i++
+			b.WriteByte(p.s[p.i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,152 @@
+package httpcache
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCacheControlQuotedFieldNames(t *testing.T) {
+	h := http.Header{}
+	h.Set("Cache-Control", `no-cache="Set-Cookie, X-Foo", private="Authorization", max-age=60`)
+	cc := ParseCacheControl(h)
+	if got, want := cc["no-cache"], "Set-Cookie, X-Foo"; got != want {
+		t.Fatalf(`"no-cache" value is %q, want %q`, got, want)
+	}
+	if got, want := cc.FieldNames("no-cache"), []string{"Set-Cookie", "X-Foo"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("no-cache field names are %v, want %v", got, want)
+	}
+	if got, want := cc.FieldNames("private"), []string{"Authorization"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("private field names are %v, want %v", got, want)
+	}
+	if got := cc["max-age"]; got != "60" {
+		t.Fatalf(`"max-age" value isn't "60": %v`, got)
+	}
+	if len(cc) != 3 {
+		t.Fatalf("got %d directives, want 3: %v", len(cc), cc)
+	}
+}
+
+func TestParseCacheControlQuotedValue(t *testing.T) {
+	h := http.Header{}
+	h.Set("Cache-Control", `max-age="60", community="UCI \"x\""`)
+	cc := ParseCacheControl(h)
+	if got := cc["max-age"]; got != "60" {
+		t.Fatalf(`"max-age" value isn't "60": %v`, got)
+	}
+	if got, want := cc["community"], `UCI "x"`; got != want {
+		t.Fatalf(`"community" value is %q, want %q`, got, want)
+	}
+}
+
+func TestParseCacheControlCaseInsensitive(t *testing.T) {
+	h := http.Header{}
+	h.Set("Cache-Control", "No-Cache, MAX-AGE=10")
+	cc := ParseCacheControl(h)
+	if !cc.Has("no-cache") || !cc.Has("No-Cache") {
+		t.Fatal(`"no-cache" isn't set`)
+	}
+	if v, ok := cc.Get("Max-Age"); !ok || v != "10" {
+		t.Fatalf(`"max-age" value isn't "10": %v`, v)
+	}
+}
+
+func TestParseCacheControlMultipleFields(t *testing.T) {
+	h := http.Header{}
+	h.Add("Cache-Control", "max-age=60")
+	h.Add("Cache-Control", "no-store")
+	cc := ParseCacheControl(h)
+	if !cc.Has("no-store") {
+		t.Fatal(`"no-store" from the second field isn't set`)
+	}
+	if cc["max-age"] != "60" {
+		t.Fatalf(`"max-age" value isn't "60": %v`, cc["max-age"])
+	}
+}
+
+func TestParseCacheControlDuplicates(t *testing.T) {
+	tests := []struct {
+		header    string
+		directive string
+		want      string
+	}{
+		{"max-age=60, max-age=10", "max-age", "10"},
+		{"max-age=10, max-age=60", "max-age", "10"},
+		{"max-age=10, max-age=abc", "max-age", "abc"},
+		{"s-maxage=5, s-maxage=50", "s-maxage", "5"},
+		{"min-fresh=5, min-fresh=50", "min-fresh", "50"},
+		{"max-stale, max-stale=30", "max-stale", "30"},
+		{"max-stale=30, max-stale", "max-stale", "30"},
+		{"stale-if-error=100, stale-if-error=20", "stale-if-error", "20"},
+		{`no-cache="X-Foo", no-cache`, "no-cache", ""},
+		{`no-cache, no-cache="X-Foo"`, "no-cache", ""},
+		{`private="X-Foo", private="X-Bar"`, "private", "X-Foo, X-Bar"},
+		{`community="a", community="b"`, "community", "a"},
+	}
+	for _, test := range tests {
+		h := http.Header{}
+		h.Set("Cache-Control", test.header)
+		got, ok := ParseCacheControl(h)[test.directive]
+		if !ok {
+			t.Errorf("%s: %q isn't set", test.header, test.directive)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: %q is %q, want %q", test.header, test.directive, got, test.want)
+		}
+	}
+}
+
+func TestParseCacheControlMalformed(t *testing.T) {
+	h := http.Header{}
+	h.Set("Cache-Control", ` , ,=5, no-store junk, max-age=5 6, private="unterminated`)
+	cc := ParseCacheControl(h)
+	want := CacheControl{"no-store": "", "max-age": "5", "private": "unterminated"}
+	if !reflect.DeepEqual(cc, want) {
+		t.Fatalf("got %v, want %v", cc, want)
+	}
+}
+
+func TestParseDeltaSeconds(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"60", 60 * time.Second, true},
+		{"007", 7 * time.Second, true},
+		{"2147483648", maxDeltaSeconds * time.Second, true},
+		{"99999999999", maxDeltaSeconds * time.Second, true},
+		{"999999999999999999999999999999", maxDeltaSeconds * time.Second, true},
+		{"", 0, false},
+		{"1.5", 0, false},
+		{"-10", 0, false},
+		{"+10", 0, false},
+		{"1e3", 0, false},
+		{"10s", 0, false},
+		{" 10", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := parseDeltaSeconds(test.value)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%q: got %v, %v, want %v, %v", test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestCacheControlDuration(t *testing.T) {
+	h := http.Header{}
+	h.Set("Cache-Control", `max-age="60", s-maxage=1.5`)
+	cc := ParseCacheControl(h)
+	if d, ok := cc.Duration("max-age"); !ok || d != time.Minute {
+		t.Errorf("max-age: got %v, %v", d, ok)
+	}
+	if _, ok := cc.Duration("s-maxage"); ok {
+		t.Error("s-maxage=1.5 is valid")
+	}
+	if _, ok := cc.Duration("min-fresh"); ok {
+		t.Error("missing min-fresh is valid")
+	}
+}
@@ -0,0 +1,108 @@
+package httpcache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// ChecksumCache is an implementation of CheckedCache that stores each response in
+// another Cache along with its length and CRC-32C checksum, and verifies both when it
+// is read, so that a truncated file or a damaged value is detected rather than served.
+// Damaged responses are deleted from the underlying cache. Responses stored before the
+// cache was wrapped have no checksum, and are returned unverified.
+type ChecksumCache struct {
+	cache Cache
+}
+
+// checksumMarker starts every entry written by ChecksumCache. A stored response
+// without a checksum always starts with 'H'.
+const checksumMarker = 0xCC
+
+// checksumHeaderSize is the size of the marker, length and checksum that precede the
+// response in an entry.
+const checksumHeaderSize = 1 + 8 + 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// NewChecksumCache returns a new ChecksumCache storing responses in c.
+func NewChecksumCache(c Cache) *ChecksumCache {
+	return &ChecksumCache{cache: c}
+}
+
+// Get returns the []byte representation of the response and true if present and
+// intact, false if not
+func (c *ChecksumCache) Get(key string) (resp []byte, ok bool) {
+	resp, ok, _ = c.GetChecked(key)
+	return resp, ok
+}
+
+// GetChecked returns the []byte representation of the response and true if present,
+// or an error wrapping ErrCorrupt if it is damaged, in which case it is deleted.
+func (c *ChecksumCache) GetChecked(key string) (resp []byte, ok bool, err error) {
+	resp, _, ok, err = c.getChecked(key)
+	return resp, ok, err
+}
+
+// GetWithExpiry returns the []byte representation of the response, the time it
+// expires if the underlying cache is an ExpiryGetter, and true if present and intact,
+// false if not
+func (c *ChecksumCache) GetWithExpiry(key string) (resp []byte, expires time.Time, ok bool) {
+	resp, expires, ok, _ = c.getChecked(key)
+	return resp, expires, ok
+}
+
+// getChecked returns the response stored with key, verified, and the time it expires.
+func (c *ChecksumCache) getChecked(key string) (resp []byte, expires time.Time, ok bool, err error) {
+	stored, expires, ok := getWithExpiry(c.cache, key)
+	if !ok {
+		return nil, time.Time{}, false, nil
+	}
+	resp, err = verifyChecksum(stored)
+	if err != nil {
+		c.cache.Delete(key)
+		return nil, time.Time{}, false, err
+	}
+	return resp, expires, true, nil
+}
+
+// Set saves response resp to the cache with key, along with its length and checksum
+func (c *ChecksumCache) Set(key string, resp []byte) {
+	c.SetWithExpiry(key, resp, time.Time{})
+}
+
+// SetWithExpiry saves response resp to the cache with key like Set, until expires if
+// the underlying cache is an ExpiringCache
+func (c *ChecksumCache) SetWithExpiry(key string, resp []byte, expires time.Time) {
+	stored := make([]byte, checksumHeaderSize+len(resp))
+	stored[0] = checksumMarker
+	binary.BigEndian.PutUint64(stored[1:], uint64(len(resp)))
+	binary.BigEndian.PutUint32(stored[9:], crc32.Checksum(resp, castagnoli))
+	copy(stored[checksumHeaderSize:], resp)
+	setWithExpiry(c.cache, key, stored, expires)
+}
+
+// Delete removes key from the cache
+func (c *ChecksumCache) Delete(key string) {
+	c.cache.Delete(key)
+}
+
+// verifyChecksum returns the response in the entry stored, checking its length and
+// checksum. An entry without a checksum is returned as it is.
+func verifyChecksum(stored []byte) ([]byte, error) {
+	if len(stored) > 0 && stored[0] == 'H' {
+		return stored, nil
+	}
+	if len(stored) < checksumHeaderSize || stored[0] != checksumMarker {
+		return nil, fmt.Errorf("%w: unrecognized entry of %d bytes", ErrCorrupt, len(stored))
+	}
+	resp := stored[checksumHeaderSize:]
+	if n := binary.BigEndian.Uint64(stored[1:]); n != uint64(len(resp)) {
+		return nil, fmt.Errorf("%w: got %d bytes, want %d", ErrCorrupt, len(resp), n)
+	}
+	if sum := binary.BigEndian.Uint32(stored[9:]); sum != crc32.Checksum(resp, castagnoli) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+	return resp, nil
+}
@@ -0,0 +1,128 @@
+package httpcache
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestChecksumCache(t *testing.T) {
+	underlying := NewMemoryCache()
+	cache := NewChecksumCache(underlying)
+
+	key := "testKey"
+	_, ok := cache.Get(key)
+	if ok {
+		t.Fatal("retrieved key before adding it")
+	}
+
+	val := []byte("some bytes")
+	cache.Set(key, val)
+
+	retVal, ok := cache.Get(key)
+	if !ok {
+		t.Fatal("could not retrieve an element we just added")
+	}
+	if !bytes.Equal(retVal, val) {
+		t.Fatal("retrieved a different value than what we put in")
+	}
+
+	cache.Delete(key)
+
+	_, ok = cache.Get(key)
+	if ok {
+		t.Fatal("deleted key still present")
+	}
+}
+
+func TestChecksumCacheCorruption(t *testing.T) {
+	underlying := NewMemoryCache()
+	cache := NewChecksumCache(underlying)
+	cache.Set("key", []byte("HTTP/1.1 200 OK\r\n\r\nsome bytes"))
+	stored, _ := underlying.Get("key")
+
+	flipped := append([]byte(nil), stored...)
+	flipped[len(flipped)-1] ^= 1
+	tests := map[string][]byte{
+		"truncated": stored[:len(stored)-1],
+		"extended":  append(append([]byte(nil), stored...), 0),
+		"flipped":   flipped,
+		"header":    stored[:5],
+		"unknown":   []byte("garbage"),
+		"empty":     {},
+	}
+	for name, damaged := range tests {
+		underlying.Set("key", damaged)
+		_, ok, err := cache.GetChecked("key")
+		if ok || !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: got ok %v, err %v, want ErrCorrupt", name, ok, err)
+		}
+		if _, ok := underlying.Get("key"); ok {
+			t.Errorf("%s: damaged entry wasn't deleted", name)
+		}
+	}
+
+	// Responses stored without a checksum are still returned
+	legacy := []byte("HTTP/1.1 200 OK\r\n\r\n")
+	underlying.Set("legacy", legacy)
+	if retVal, ok, err := cache.GetChecked("legacy"); !ok || err != nil || !bytes.Equal(retVal, legacy) {
+		t.Errorf("legacy entry: got ok %v, err %v", ok, err)
+	}
+}
+
+func TestCorruptResponseRoundTrip(t *testing.T) {
+	for _, checked := range []bool{false, true} {
+		resetTest()
+		underlying := NewMemoryCache()
+		var cache Cache = underlying
+		if checked {
+			cache = NewChecksumCache(underlying)
+		}
+		var events []Event
+		tp := NewTransport(cache)
+		tp.Observer = func(e Event) { events = append(events, e) }
+		tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return newResponse(http.StatusOK, "some data", "Cache-Control", "max-age=60"), nil
+		})
+
+		r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+		resp, err := tp.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+
+		// Damage the stored response: with a checksum, any change is caught, and
+		// without one only a response that can't be parsed
+		stored, _ := underlying.Get("http://somewhere.com/")
+		if checked {
+			stored = stored[:len(stored)-2]
+		} else {
+			stored = []byte("garbage")
+		}
+		underlying.Set("http://somewhere.com/", stored)
+
+		resp, err = tp.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.Header.Get(XFromCache) != "" || string(body) != "some data" {
+			t.Fatalf("checked %v: damaged response was served: %q", checked, body)
+		}
+		if len(events) != 1 || events[0].Kind != EventCorrupt || !errors.Is(events[0].Err, ErrCorrupt) {
+			t.Fatalf("checked %v: got events %v, want one %v", checked, events, EventCorrupt)
+		}
+
+		// The response from the origin replaced the damaged one
+		resp, err = tp.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.Get(XFromCache) != "1" {
+			t.Fatalf("checked %v: response wasn't stored again", checked)
+		}
+	}
+}
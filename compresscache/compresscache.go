@@ -0,0 +1,277 @@
+// Package compresscache provides an implementation of httpcache.Cache that compresses
+// responses before storing them in another Cache.
+//
+// Each entry starts with a byte identifying the codec that compressed it, or RawID for
+// an entry that wasn't worth compressing and is stored as it is. Entries written before
+// the cache was wrapped are responses, which always start with "HTTP/", so they are
+// still read, and a Cache that was filled without compression can be wrapped without
+// being emptied first.
+package compresscache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregjones/httpcache"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A Codec compresses and decompresses entries.
+type Codec interface {
+	// ID identifies the codec in stored entries. It must be unique among the
+	// codecs used with a cache, and can't be RawID or 'H'.
+	ID() byte
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+}
+
+// Codec IDs used by the codecs in this package, and RawID, which marks entries stored
+// uncompressed.
+const (
+	RawID  byte = 0
+	GzipID byte = 1
+	ZstdID byte = 2
+)
+
+// legacyID starts the entries stored before the cache was wrapped, which are
+// uncompressed responses.
+const legacyID = 'H'
+
+type gzipCodec struct {
+	level int
+}
+
+// NewGzipCodec returns a Codec using gzip at the given compression level, such as
+// gzip.DefaultCompression.
+func NewGzipCodec(level int) Codec {
+	return gzipCodec{level: level}
+}
+
+func (c gzipCodec) ID() byte {
+	return GzipID
+}
+
+func (c gzipCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gzipCodec) Decode(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// NewZstdCodec returns a Codec using zstd at the given compression level, such as
+// zstd.SpeedDefault.
+func NewZstdCodec(level zstd.EncoderLevel) (Codec, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	return zstdCodec{enc: enc, dec: sharedZstdDecoder()}, nil
+}
+
+var (
+	zstdDecoderOnce sync.Once
+	zstdDecoder     *zstd.Decoder
+)
+
+// sharedZstdDecoder returns the decoder shared by every zstd codec. DecodeAll makes it
+// safe for concurrent use.
+func sharedZstdDecoder() *zstd.Decoder {
+	zstdDecoderOnce.Do(func() {
+		// NewReader only fails for invalid options
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+	return zstdDecoder
+}
+
+func (c zstdCodec) ID() byte {
+	return ZstdID
+}
+
+func (c zstdCodec) Encode(src []byte) ([]byte, error) {
+	return c.enc.EncodeAll(src, nil), nil
+}
+
+func (c zstdCodec) Decode(src []byte) ([]byte, error) {
+	return c.dec.DecodeAll(src, nil)
+}
+
+// Cache is an implementation of httpcache.Cache that compresses responses before
+// storing them in an underlying Cache.
+type Cache struct {
+	// MinSize is the size below which entries are stored uncompressed.
+	MinSize int
+
+	cache  httpcache.Cache
+	codec  Codec
+	codecs map[byte]Codec
+}
+
+// DefaultMinSize is the default value of Cache.MinSize.
+const DefaultMinSize = 512
+
+// New returns a new Cache that stores entries in cache, compressed with codec. Entries
+// compressed with the gzip or zstd codecs of this package, or with any of the extra
+// codecs given, can also be read, so that the codec can be changed without emptying
+// cache. It fails if a codec's ID is RawID or 'H'.
+func New(cache httpcache.Cache, codec Codec, extra ...Codec) (*Cache, error) {
+	for _, c := range append([]Codec{codec}, extra...) {
+		if id := c.ID(); id == RawID || id == legacyID {
+			return nil, fmt.Errorf("compresscache: codec ID %d is reserved", id)
+		}
+	}
+	c := &Cache{
+		MinSize: DefaultMinSize,
+		cache:   cache,
+		codec:   codec,
+		codecs: map[byte]Codec{
+			GzipID: NewGzipCodec(gzip.DefaultCompression),
+			// Only ever used to decode, so it needs no encoder
+			ZstdID: zstdCodec{dec: sharedZstdDecoder()},
+		},
+	}
+	for _, extraCodec := range extra {
+		c.codecs[extraCodec.ID()] = extraCodec
+	}
+	c.codecs[codec.ID()] = codec
+	return c, nil
+}
+
+// Get returns the response corresponding to key, decompressed, if present. An entry
+// that can't be decompressed is treated as missing.
+func (c *Cache) Get(key string) (resp []byte, ok bool) {
+	resp, _, ok = c.GetWithExpiry(key)
+	return resp, ok
+}
+
+// GetWithExpiry returns the response corresponding to key, decompressed, if present,
+// and the time it expires if the underlying cache is an httpcache.ExpiryGetter.
+func (c *Cache) GetWithExpiry(key string) (resp []byte, expires time.Time, ok bool) {
+	var stored []byte
+	if eg, isGetter := c.cache.(httpcache.ExpiryGetter); isGetter {
+		stored, expires, ok = eg.GetWithExpiry(key)
+	} else {
+		stored, ok = c.cache.Get(key)
+	}
+	if !ok || len(stored) == 0 {
+		return nil, time.Time{}, false
+	}
+	switch stored[0] {
+	case RawID:
+		return stored[1:], expires, true
+	case legacyID:
+		return stored, expires, true
+	}
+	codec, ok := c.codecs[stored[0]]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	resp, err := codec.Decode(stored[1:])
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	return resp, expires, true
+}
+
+// Set saves a response to the cache as key, compressed unless it is smaller than
+// MinSize, its body is already compressed, or compression wouldn't make it smaller.
+func (c *Cache) Set(key string, resp []byte) {
+	c.SetWithExpiry(key, resp, time.Time{})
+}
+
+// SetWithExpiry saves a response to the cache as key like Set, until expires if the
+// underlying cache is an httpcache.ExpiringCache.
+func (c *Cache) SetWithExpiry(key string, resp []byte, expires time.Time) {
+	stored := tagged(RawID, resp)
+	if len(resp) >= c.MinSize && !alreadyCompressed(resp) {
+		if compressed, err := c.codec.Encode(resp); err == nil && len(compressed) < len(resp) {
+			stored = tagged(c.codec.ID(), compressed)
+		}
+	}
+	if ec, ok := c.cache.(httpcache.ExpiringCache); ok {
+		ec.SetWithExpiry(key, stored, expires)
+	} else {
+		c.cache.Set(key, stored)
+	}
+}
+
+// tagged returns the entry holding data, starting with id.
+func tagged(id byte, data []byte) []byte {
+	stored := make([]byte, len(data)+1)
+	stored[0] = id
+	copy(stored[1:], data)
+	return stored
+}
+
+// Delete removes the response with key from the cache
+func (c *Cache) Delete(key string) {
+	c.cache.Delete(key)
+}
+
+// compressedTypes are media types, or top-level types ending in '/', whose content is
+// already compressed.
+var compressedTypes = []string{
+	"image/", "audio/", "video/", "font/woff", "font/woff2",
+	"application/gzip", "application/x-gzip", "application/zip", "application/zstd",
+	"application/x-bzip2", "application/x-xz", "application/x-7z-compressed",
+	"application/vnd.rar",
+}
+
+// alreadyCompressed reports whether the body of the stored response resp has a content
+// coding other than identity, or a Content-Type that is already compressed. SVG images
+// are text, and still compress well.
+func alreadyCompressed(resp []byte) bool {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(resp)))
+	if _, err := r.ReadLine(); err != nil {
+		return false
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return false
+	}
+	if enc := strings.TrimSpace(header.Get("Content-Encoding")); enc != "" && !strings.EqualFold(enc, "identity") {
+		return true
+	}
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(contentType)
+	if contentType == "image/svg+xml" {
+		return false
+	}
+	for _, t := range compressedTypes {
+		if contentType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t)) {
+			return true
+		}
+	}
+	return false
+}
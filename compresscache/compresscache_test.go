@@ -0,0 +1,189 @@
+package compresscache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gregjones/httpcache"
+	"github.com/klauspost/compress/zstd"
+)
+
+// dump returns a stored response with the given headers and body.
+func dump(header, body string) []byte {
+	return []byte("HTTP/1.1 200 OK\r\n" + header + "Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body)
+}
+
+var text = strings.Repeat(`{"id": 1, "name": "some name", "tags": ["a", "b"]}`, 100)
+
+func codecs(t *testing.T) []Codec {
+	zc, err := NewZstdCodec(zstd.SpeedDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []Codec{NewGzipCodec(gzip.DefaultCompression), zc}
+}
+
+// newCache returns a new Cache, failing t if New does.
+func newCache(t *testing.T, cache httpcache.Cache, codec Codec, extra ...Codec) *Cache {
+	c, err := New(cache, codec, extra...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCompressCache(t *testing.T) {
+	for _, codec := range codecs(t) {
+		underlying := httpcache.NewMemoryCache()
+		cache := newCache(t, underlying, codec)
+
+		key := "testKey"
+		_, ok := cache.Get(key)
+		if ok {
+			t.Fatal("retrieved key before adding it")
+		}
+
+		val := dump("Content-Type: application/json\r\n", text)
+		cache.Set(key, val)
+
+		retVal, ok := cache.Get(key)
+		if !ok {
+			t.Fatal("could not retrieve an element we just added")
+		}
+		if !bytes.Equal(retVal, val) {
+			t.Fatal("retrieved a different value than what we put in")
+		}
+		stored, _ := underlying.Get(key)
+		if stored[0] != codec.ID() || len(stored) >= len(val)/5 {
+			t.Fatalf("codec %d: stored %d bytes for %d starting with %d", codec.ID(), len(stored), len(val), stored[0])
+		}
+
+		cache.Delete(key)
+
+		_, ok = cache.Get(key)
+		if ok {
+			t.Fatal("deleted key still present")
+		}
+	}
+}
+
+func TestCompressCacheStoresUncompressed(t *testing.T) {
+	tests := []struct {
+		name string
+		val  []byte
+	}{
+		{"small", dump("Content-Type: text/plain\r\n", "hello")},
+		{"image", dump("Content-Type: image/png\r\n", text)},
+		{"zip", dump("Content-Type: application/zip; foo=bar\r\n", text)},
+		{"content-encoding", dump("Content-Type: text/plain\r\nContent-Encoding: gzip\r\n", text)},
+		{"incompressible", dump("Content-Type: text/plain\r\n", string(random(2000)))},
+	}
+	for _, test := range tests {
+		underlying := httpcache.NewMemoryCache()
+		cache := newCache(t, underlying, NewGzipCodec(gzip.BestSpeed))
+		cache.Set("key", test.val)
+		if stored, _ := underlying.Get("key"); stored[0] != RawID || !bytes.Equal(stored[1:], test.val) {
+			t.Errorf("%s: response was compressed", test.name)
+		}
+		if retVal, ok := cache.Get("key"); !ok || !bytes.Equal(retVal, test.val) {
+			t.Errorf("%s: response isn't returned", test.name)
+		}
+	}
+
+	// SVG images are text, so they are compressed
+	underlying := httpcache.NewMemoryCache()
+	newCache(t, underlying, NewGzipCodec(gzip.BestSpeed)).Set("key", dump("Content-Type: image/svg+xml\r\n", text))
+	if stored, _ := underlying.Get("key"); stored[0] != GzipID {
+		t.Error("svg response wasn't compressed")
+	}
+}
+
+// random returns n bytes that don't compress.
+func random(n int) []byte {
+	b := make([]byte, n)
+	x := uint32(2463534242)
+	for i := range b {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		b[i] = byte(x)
+	}
+	return b
+}
+
+func TestCompressCacheChangeCodec(t *testing.T) {
+	underlying := httpcache.NewMemoryCache()
+	legacy := dump("Content-Type: text/plain\r\n", text)
+	underlying.Set("legacy", legacy)
+
+	zc := codecs(t)[1]
+	newCache(t, underlying, zc).Set("zstd", legacy)
+	cache := newCache(t, underlying, NewGzipCodec(gzip.DefaultCompression))
+	for _, key := range []string{"legacy", "zstd"} {
+		if retVal, ok := cache.Get(key); !ok || !bytes.Equal(retVal, legacy) {
+			t.Errorf("%s entry isn't readable", key)
+		}
+	}
+}
+
+func TestCompressCacheCorrupt(t *testing.T) {
+	underlying := httpcache.NewMemoryCache()
+	cache := newCache(t, underlying, NewGzipCodec(gzip.DefaultCompression))
+	underlying.Set("corrupt", []byte{GzipID, 1, 2, 3})
+	underlying.Set("unknown", []byte{99, 1, 2, 3})
+	for _, key := range []string{"corrupt", "unknown"} {
+		if _, ok := cache.Get(key); ok {
+			t.Errorf("%s entry was returned", key)
+		}
+	}
+}
+
+// idCodec is a gzip Codec with another ID.
+type idCodec struct {
+	Codec
+	id byte
+}
+
+func (c idCodec) ID() byte {
+	return c.id
+}
+
+func TestCompressCacheReservedID(t *testing.T) {
+	for _, id := range []byte{RawID, 'H'} {
+		codec := idCodec{NewGzipCodec(gzip.DefaultCompression), id}
+		if _, err := New(httpcache.NewMemoryCache(), codec); err == nil {
+			t.Errorf("codec ID %d was accepted", id)
+		}
+		if _, err := New(httpcache.NewMemoryCache(), NewGzipCodec(gzip.DefaultCompression), codec); err == nil {
+			t.Errorf("extra codec ID %d was accepted", id)
+		}
+	}
+}
+
+func TestCompressCacheAnyValue(t *testing.T) {
+	// Values other than responses, small or large, are returned as they were stored
+	cache := newCache(t, httpcache.NewMemoryCache(), NewGzipCodec(gzip.DefaultCompression))
+	for _, val := range [][]byte{{}, []byte("1"), {GzipID, 1, 2}, {0xDD}, []byte(text)} {
+		cache.Set("key", val)
+		if retVal, ok := cache.Get("key"); !ok || !bytes.Equal(retVal, val) {
+			t.Errorf("%.10q: got %.10q, %v", val, retVal, ok)
+		}
+	}
+
+	// Including those of the wrappers in httpcache
+	wrappers := map[string]httpcache.Cache{
+		"DedupCache":    httpcache.NewDedupCache(newCache(t, httpcache.NewMemoryCache(), NewGzipCodec(gzip.DefaultCompression))),
+		"ChecksumCache": httpcache.NewChecksumCache(newCache(t, httpcache.NewMemoryCache(), NewGzipCodec(gzip.DefaultCompression))),
+	}
+	for name, cache := range wrappers {
+		for _, val := range [][]byte{dump("Content-Type: text/plain\r\n", "hello"), dump("Content-Type: text/plain\r\n", text)} {
+			cache.Set("key", val)
+			if retVal, ok := cache.Get("key"); !ok || !bytes.Equal(retVal, val) {
+				t.Errorf("%s: %d byte response isn't returned", name, len(val))
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package httpcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DedupCache is an implementation of Cache that stores each distinct response body
+// only once, however many keys it is stored under, which saves space when mirrors,
+// aliases or query variations of a URL return identical bodies.
+//
+// Each response is split into a small record, holding its status line and headers and
+// the SHA-256 of its body, and the body, which is stored under its hash together with
+// a count of the records referring to it. The body is deleted when the last record
+// referring to it is replaced or deleted. Records, bodies and counts all live in the
+// underlying cache, which must not be shared with another DedupCache; a crash part
+// way through a Set or Delete can leave a body behind, but never removes one still
+// in use.
+//
+// The underlying cache may evict entries, as LRUCache, diskcache with a MaxSize or
+// memcache do. A record whose body was evicted is a miss until the response is stored
+// again. A body whose count was evicted is no longer known to be unused, so DedupCache
+// never deletes it, and leaves it for the underlying cache to evict in turn.
+//
+// Expiry times are kept in the records rather than passed to the underlying cache,
+// which would drop an expired record without releasing its body. An expired record is
+// a miss, and releases its body when it is next read, replaced or deleted.
+type DedupCache struct {
+	mu    sync.Mutex
+	cache Cache
+}
+
+const (
+	// dedupMarker starts every record written by DedupCache without an expiry time,
+	// and dedupExpiringMarker those followed by one. A stored response without
+	// deduplication always starts with 'H'.
+	dedupMarker         = 0xDD
+	dedupExpiringMarker = 0xDE
+	dedupBodyPrefix     = "dedup-body:"
+	dedupRefsPrefix = "dedup-refs:"
+)
+
+// NewDedupCache returns a new DedupCache storing responses in c.
+func NewDedupCache(c Cache) *DedupCache {
+	return &DedupCache{cache: c}
+}
+
+// Get returns the []byte representation of the response and true if present, false if not
+func (c *DedupCache) Get(key string) (resp []byte, ok bool) {
+	resp, _, ok = c.GetWithExpiry(key)
+	return resp, ok
+}
+
+// GetWithExpiry returns the []byte representation of the response, the time it
+// expires, and true if present and not expired, false if not
+func (c *DedupCache) GetWithExpiry(key string) (resp []byte, expires time.Time, ok bool) {
+	record, expires, ok := getWithExpiry(c.cache, key)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	head, hash, expires, ok := parseDedupRecord(record)
+	if !ok {
+		// Stored as it is
+		return record, expires, true
+	}
+	if !expires.IsZero() && !time.Now().Before(expires) {
+		c.mu.Lock()
+		// Unless it was replaced in the meantime
+		if again, ok := c.cache.Get(key); ok && bytes.Equal(again, record) {
+			c.release(key)
+			c.cache.Delete(key)
+		}
+		c.mu.Unlock()
+		return nil, time.Time{}, false
+	}
+	body, ok := c.cache.Get(dedupBodyPrefix + hash)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	resp = make([]byte, 0, len(head)+len(body))
+	return append(append(resp, head...), body...), expires, true
+}
+
+// Set saves response resp to the cache with key, storing its body only if no other
+// key holds the same body already
+func (c *DedupCache) Set(key string, resp []byte) {
+	c.SetWithExpiry(key, resp, time.Time{})
+}
+
+// SetWithExpiry saves response resp to the cache with key like Set, to be a miss from
+// expires on, unless that is zero
+func (c *DedupCache) SetWithExpiry(key string, resp []byte, expires time.Time) {
+	i := bytes.Index(resp, []byte("\r\n\r\n"))
+	if i < 0 {
+		// Not a response, so there is no body to share, and nothing to release when
+		// the underlying cache drops it
+		c.mu.Lock()
+		c.release(key)
+		setWithExpiry(c.cache, key, resp, expires)
+		c.mu.Unlock()
+		return
+	}
+	head, body := resp[:i+4], resp[i+4:]
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+	record := make([]byte, 0, 1+8+len(hash)+len(head))
+	if expires.IsZero() {
+		record = append(record, dedupMarker)
+	} else {
+		record = append(record, dedupExpiringMarker, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(record[1:], uint64(expires.UnixNano()))
+	}
+	record = append(append(record, hash...), head...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Take the new reference before dropping the old one, so that a body shared
+	// by both is never deleted
+	c.addRef(hash, body)
+	c.release(key)
+	c.cache.Set(key, record)
+}
+
+// Delete removes key from the cache, and its body if no other key refers to it
+func (c *DedupCache) Delete(key string) {
+	c.mu.Lock()
+	c.release(key)
+	c.cache.Delete(key)
+	c.mu.Unlock()
+}
+
+// addRef counts a new record referring to body, which has hash, storing body if it
+// isn't stored already. c.mu must be held.
+func (c *DedupCache) addRef(hash string, body []byte) {
+	refs, counted := c.refs(hash)
+	_, stored := c.cache.Get(dedupBodyPrefix + hash)
+	switch {
+	case counted:
+		c.cache.Set(dedupRefsPrefix+hash, []byte(strconv.Itoa(refs+1)))
+	case stored:
+		// The count was evicted, so other records may refer to the body without
+		// being counted: it stays uncounted, and is never deleted
+	default:
+		c.cache.Set(dedupRefsPrefix+hash, []byte("1"))
+	}
+	if !stored {
+		c.cache.Set(dedupBodyPrefix+hash, body)
+	}
+}
+
+// release drops the reference held by the record stored under key, if any, deleting
+// the body it refers to if that was the last one. c.mu must be held.
+func (c *DedupCache) release(key string) {
+	record, ok := c.cache.Get(key)
+	if !ok {
+		return
+	}
+	_, hash, _, ok := parseDedupRecord(record)
+	if !ok {
+		return
+	}
+	refs, counted := c.refs(hash)
+	if !counted {
+		// The count was evicted, so whether other records use the body is unknown
+		return
+	}
+	if refs > 1 {
+		c.cache.Set(dedupRefsPrefix+hash, []byte(strconv.Itoa(refs-1)))
+		return
+	}
+	c.cache.Delete(dedupRefsPrefix + hash)
+	c.cache.Delete(dedupBodyPrefix + hash)
+}
+
+// refs returns the number of records referring to the body with hash, and whether
+// that number is known. c.mu must be held.
+func (c *DedupCache) refs(hash string) (refs int, counted bool) {
+	stored, ok := c.cache.Get(dedupRefsPrefix + hash)
+	if !ok {
+		return 0, false
+	}
+	refs, err := strconv.Atoi(string(stored))
+	return refs, err == nil && refs > 0
+}
+
+// parseDedupRecord returns the status line and headers stored in record, the hash of
+// the body it refers to, and the time it expires, which is zero if it never does. ok
+// is false if record isn't a DedupCache record.
+func parseDedupRecord(record []byte) (head []byte, hash string, expires time.Time, ok bool) {
+	const hashLen = 2 * sha256.Size
+	if len(record) > 0 && record[0] == dedupExpiringMarker && len(record) >= 1+8+hashLen {
+		expires = time.Unix(0, int64(binary.BigEndian.Uint64(record[1:])))
+		record = record[8:]
+	} else if len(record) < 1+hashLen || record[0] != dedupMarker {
+		return nil, "", time.Time{}, false
+	}
+	return record[1+hashLen:], string(record[1 : 1+hashLen]), expires, true
+}
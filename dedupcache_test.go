@@ -0,0 +1,197 @@
+package httpcache
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupCache(t *testing.T) {
+	cache := NewDedupCache(NewMemoryCache())
+
+	key := "testKey"
+	_, ok := cache.Get(key)
+	if ok {
+		t.Fatal("retrieved key before adding it")
+	}
+
+	val := []byte("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nsome bytes")
+	cache.Set(key, val)
+
+	retVal, ok := cache.Get(key)
+	if !ok {
+		t.Fatal("could not retrieve an element we just added")
+	}
+	if !bytes.Equal(retVal, val) {
+		t.Fatal("retrieved a different value than what we put in")
+	}
+
+	cache.Delete(key)
+
+	_, ok = cache.Get(key)
+	if ok {
+		t.Fatal("deleted key still present")
+	}
+}
+
+// storedBodies returns the number of bodies in the underlying cache of c.
+func storedBodies(c *MemoryCache) int {
+	n := 0
+	for key := range c.items {
+		if strings.HasPrefix(key, dedupBodyPrefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDedupCacheSharesBodies(t *testing.T) {
+	underlying := NewMemoryCache()
+	cache := NewDedupCache(underlying)
+	body := strings.Repeat("some bytes", 100)
+	a := []byte("HTTP/1.1 200 OK\r\nEtag: \"a\"\r\n\r\n" + body)
+	b := []byte("HTTP/1.1 200 OK\r\nEtag: \"b\"\r\n\r\n" + body)
+	other := []byte("HTTP/1.1 200 OK\r\n\r\nother bytes")
+
+	cache.Set("a", a)
+	cache.Set("b", b)
+	if n := storedBodies(underlying); n != 1 {
+		t.Fatalf("got %d bodies, want 1", n)
+	}
+	for key, want := range map[string][]byte{"a": a, "b": b} {
+		if got, ok := cache.Get(key); !ok || !bytes.Equal(got, want) {
+			t.Fatalf("%s: got %q", key, got)
+		}
+	}
+
+	// Storing the same response again doesn't take another reference
+	cache.Set("a", a)
+	// Replacing a response releases its body, which b still uses
+	cache.Set("a", other)
+	if n := storedBodies(underlying); n != 2 {
+		t.Fatalf("got %d bodies, want 2", n)
+	}
+	if got, ok := cache.Get("b"); !ok || !bytes.Equal(got, b) {
+		t.Fatalf("shared body was lost: %q", got)
+	}
+
+	cache.Delete("b")
+	if n := storedBodies(underlying); n != 1 {
+		t.Fatalf("got %d bodies after deleting the last reference, want 1", n)
+	}
+	cache.Delete("a")
+	if len(underlying.items) != 0 {
+		t.Fatalf("underlying cache isn't empty: %d entries", len(underlying.items))
+	}
+}
+
+func TestDedupCacheUndeduplicated(t *testing.T) {
+	underlying := NewMemoryCache()
+	cache := NewDedupCache(underlying)
+
+	// Responses stored before deduplication are returned as they are
+	legacy := []byte("HTTP/1.1 200 OK\r\n\r\nsome bytes")
+	underlying.Set("legacy", legacy)
+	if got, ok := cache.Get("legacy"); !ok || !bytes.Equal(got, legacy) {
+		t.Fatalf("legacy entry: got %q", got)
+	}
+	cache.Delete("legacy")
+
+	// A record whose body is missing is a miss
+	cache.Set("key", legacy)
+	for key := range underlying.items {
+		if strings.HasPrefix(key, dedupBodyPrefix) {
+			underlying.Delete(key)
+		}
+	}
+	if _, ok := cache.Get("key"); ok {
+		t.Fatal("record without a body was returned")
+	}
+}
+
+func TestDedupCacheTransport(t *testing.T) {
+	resetTest()
+	tp := NewTransport(NewDedupCache(NewMemoryCache()))
+	tp.Transport = s.transport.Transport
+	client := tp.Client()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(s.server.URL + "/method")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if i == 1 && resp.Header.Get(XFromCache) != "1" {
+			t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+		}
+	}
+}
+
+func TestDedupCacheExpiry(t *testing.T) {
+	underlying := NewMemoryCache()
+	cache := NewDedupCache(underlying)
+	resp := []byte("HTTP/1.1 200 OK\r\n\r\nsome bytes")
+	cache.SetWithExpiry("dead", resp, time.Now().Add(-time.Second))
+	cache.SetWithExpiry("alive", resp, time.Now().Add(time.Hour))
+
+	// The underlying cache never drops a record without its body being released
+	if n := underlying.Sweep(); n != 0 {
+		t.Fatalf("Sweep removed %d entries, want 0", n)
+	}
+	if _, ok := cache.Get("dead"); ok {
+		t.Fatal("expired response was returned")
+	}
+	if got, ok := cache.Get("alive"); !ok || !bytes.Equal(got, resp) {
+		t.Fatalf("shared body was lost: %q", got)
+	}
+
+	// Reading the expired record released its reference, so once the other record
+	// is deleted nothing is left behind
+	cache.Delete("alive")
+	if len(underlying.items) != 0 {
+		t.Fatalf("underlying cache isn't empty: %d entries", len(underlying.items))
+	}
+}
+
+func TestDedupCacheEvictedCount(t *testing.T) {
+	underlying := NewMemoryCache()
+	cache := NewDedupCache(underlying)
+	resp := []byte("HTTP/1.1 200 OK\r\n\r\nsome bytes")
+	cache.Set("a", resp)
+	cache.Set("b", resp)
+
+	// Once its count is evicted, the body is kept whatever happens to the records
+	// referring to it
+	var refsKey string
+	for key := range underlying.items {
+		if strings.HasPrefix(key, dedupRefsPrefix) {
+			refsKey = key
+		}
+	}
+	underlying.Delete(refsKey)
+	cache.Set("c", resp)
+	cache.Delete("a")
+	cache.Delete("c")
+	if got, ok := cache.Get("b"); !ok || !bytes.Equal(got, resp) {
+		t.Fatalf("body still in use was deleted: %q", got)
+	}
+	if _, ok := underlying.Get(refsKey); ok {
+		t.Fatal("count was recreated for a body of unknown use")
+	}
+
+	// A body that was evicted is stored again, and counted afresh
+	cache.Delete("b")
+	for key := range underlying.items {
+		if strings.HasPrefix(key, dedupBodyPrefix) {
+			underlying.Delete(key)
+		}
+	}
+	cache.Set("d", resp)
+	if got, ok := cache.Get("d"); !ok || !bytes.Equal(got, resp) {
+		t.Fatalf("evicted body wasn't stored again: %q", got)
+	}
+	cache.Delete("d")
+	if len(underlying.items) != 0 {
+		t.Fatalf("underlying cache isn't empty: %d entries", len(underlying.items))
+	}
+}
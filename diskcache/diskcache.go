@@ -1,41 +1,347 @@
 // Package diskcache provides an implementation of httpcache.Cache that uses the diskv package
 // to supplement an in-memory map with persistent storage
-//
 package diskcache
 
 import (
 	"bytes"
 	"crypto/md5"
 	"encoding/hex"
-	"github.com/peterbourgon/diskv"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/diskv"
 )
 
 // Cache is an implementation of httpcache.Cache that supplements the in-memory map with persistent storage
 type Cache struct {
-	d *diskv.Diskv
+	d       *diskv.Diskv
+	maxSize int64
+	index   *index
+	noSync  bool
+	onError func(error)
+
+	shardLevels int
+	sidecars    bool
 }
 
-// Get returns the response corresponding to key if present
+// Options configures a Cache made with NewWithOptions. Such a Cache keeps the size,
+// access time and expiry time of each response in an index file in the cache
+// directory, which is rebuilt from the stored files if it's missing.
+//
+// Several processes may share the directory of such a Cache: the index is guarded by
+// an advisory lock on a lock file next to it, and every process reads the files from
+// disk rather than keeping them in memory.
+type Options struct {
+	// MaxSize is the maximum total size in bytes of the responses stored on disk.
+	// When it's exceeded the least recently used responses are removed. Zero means
+	// no limit.
+	MaxSize int64
+
+	// NoSync skips flushing each response to stable storage before it replaces the
+	// previous one. Writes are faster, but a crash of the machine may leave an
+	// empty or partial response behind.
+	NoSync bool
+
+	// OnError is called with the errors that Set, Get and Delete can't return, such
+	// as a failure to write a response. If it's nil they are logged.
+	OnError func(error)
+
+	// ShardLevels selects the sharded layout if it isn't zero: each response is
+	// stored in a file named by the SHA-256 of its key in hex, ShardLevels
+	// subdirectories deep, the subdirectories being named by the leading bytes of
+	// the file name, as in ab/cd/abcd…. The file starts with the key, which is
+	// checked when it's read so that a collision is detected rather than served.
+	// It may be at most 4.
+	//
+	// Zero selects the flat layout of New, in which each file is named by the MD5
+	// of its key, in the cache directory itself, which slows down as the directory
+	// fills. The keys of responses stored in the flat layout can't be recovered
+	// from their names, so they are moved to the sharded layout as they are read.
+	ShardLevels int
+
+	// Sidecars writes the Metadata of each response, including its key, as JSON
+	// next to the file of the response, in a file of the same name ending in
+	// .json, so that the cache directory can be searched with standard tools.
+	// Filename returns the file of a key. Responses removed by hand, along with
+	// their sidecars, are dropped from the index when they are next read.
+	Sidecars bool
+}
+
+// Get returns the response corresponding to key if present and not expired
 func (c *Cache) Get(key string) (resp []byte, ok bool) {
-	key = keyToFilename(key)
-	resp, err := c.d.Read(key)
+	resp, _, ok = c.GetWithExpiry(key)
+	return resp, ok
+}
+
+// GetWithExpiry returns the response corresponding to key if present and not expired,
+// and the time it expires, which is zero if it never does.
+func (c *Cache) GetWithExpiry(key string) (resp []byte, expires time.Time, ok bool) {
+	name := c.name(key)
+	if c.index == nil {
+		resp, err := c.d.Read(name)
+		if err != nil {
+			return []byte{}, time.Time{}, false
+		}
+		return resp, time.Time{}, true
+	}
+
+	// Readers share the lock, unless the response has to be moved to the sharded
+	// layout, which changes the index
+	unlock := c.index.RUnlock
+	err := c.index.RLock()
+	if err == nil && c.shardLevels > 0 && c.index.Has(keyToFilename(key)) && !c.index.Has(name) {
+		c.index.RUnlock()
+		unlock = c.index.Unlock
+		if err = c.index.Lock(); err == nil {
+			c.migrate(key, name)
+		}
+	}
+	if err != nil {
+		c.error(err)
+		return []byte{}, time.Time{}, false
+	}
+	resp, expires, ok, missing := c.read(key, name)
+	unlock()
+	if missing {
+		// Removed by hand, or by a Cache that hadn't added it to the index yet
+		c.forget(name)
+	}
+	return resp, expires, ok
+}
+
+// read reads the response for key from the file named name, and reports whether the
+// file is missing although the index has it. c.index must be locked.
+func (c *Cache) read(key, name string) (resp []byte, expires time.Time, ok, missing bool) {
+	if c.index.Use(name) {
+		return []byte{}, time.Time{}, false, false
+	}
+	resp, err := c.d.Read(name)
 	if err != nil {
-		return []byte{}, false
+		if os.IsNotExist(err) {
+			return []byte{}, time.Time{}, false, c.index.Has(name)
+		}
+		c.error(err)
+		return []byte{}, time.Time{}, false, false
+	}
+	if c.shardLevels > 0 {
+		storedKey, stored, err := decodeKey(resp)
+		if err != nil {
+			c.error(fmt.Errorf("%s: %v", c.path(name), err))
+			return []byte{}, time.Time{}, false, false
+		}
+		if storedKey != key {
+			c.error(fmt.Errorf("%s holds the response for %q, not %q", c.path(name), storedKey, key))
+			return []byte{}, time.Time{}, false, false
+		}
+		resp = stored
+	}
+	return resp, c.index.Expiry(name), true, false
+}
+
+// forget drops the response name from the index if its file is missing.
+func (c *Cache) forget(name string) {
+	if err := c.index.Lock(); err != nil {
+		c.error(err)
+		return
+	}
+	defer c.index.Unlock()
+	// Unless it was stored again in the meantime
+	if _, err := os.Stat(c.path(name)); os.IsNotExist(err) {
+		c.index.Remove(name)
 	}
-	return resp, true
 }
 
 // Set saves a response to the cache as key
 func (c *Cache) Set(key string, resp []byte) {
-	key = keyToFilename(key)
-	c.d.WriteStream(key, bytes.NewReader(resp), true)
+	c.SetWithExpiry(key, resp, time.Time{})
+}
+
+// SetWithExpiry saves a response to the cache as key, to be removed from expires on.
+// A zero expires, or a Cache made without NewWithOptions, means it never expires.
+// With ExpireDead set, Transport uses SetWithExpiry to pass on when the responses it
+// stores become useless.
+//
+// The response is written to a temporary file which then replaces the previous one,
+// so readers see either the whole of one or the other.
+func (c *Cache) SetWithExpiry(key string, resp []byte, expires time.Time) {
+	name := c.name(key)
+	if c.index == nil {
+		if err := c.d.WriteStream(name, bytes.NewReader(resp), true); err != nil {
+			c.error(err)
+		}
+		return
+	}
+
+	original := resp
+	if c.shardLevels > 0 {
+		resp = encodeKey(key, resp)
+	}
+	tmp, err := c.writeTemp(resp)
+	if err != nil {
+		c.error(err)
+		return
+	}
+	if err := c.index.Lock(); err != nil {
+		os.Remove(tmp)
+		c.error(err)
+		return
+	}
+	defer c.index.Unlock()
+	// Moved into place under the lock, so that the index always agrees with the
+	// files on which response replaced which
+	if err := c.place(tmp, c.path(name)); err != nil {
+		c.error(err)
+		return
+	}
+	c.index.Add(name, int64(len(resp)), expires)
+	if c.sidecars {
+		c.writeSidecar(key, name, original, expires)
+	}
+	if c.shardLevels > 0 {
+		c.dropFlat(key)
+	}
+	if c.maxSize > 0 {
+		c.erase(c.index.Evict(c.maxSize))
+	}
+}
+
+// writeTemp writes resp to a new temporary file in the cache directory, flushed to
+// stable storage unless c.noSync, and returns its name.
+func (c *Cache) writeTemp(resp []byte) (name string, err error) {
+	dir := filepath.Join(c.d.BasePath, tempDirName)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, "")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(resp)
+	if err == nil && !c.noSync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
 }
 
 // Delete removes the response with key from the cache
 func (c *Cache) Delete(key string) {
-	key = keyToFilename(key)
-	c.d.Erase(key)
+	name := c.name(key)
+	if c.index == nil {
+		c.d.Erase(name)
+		return
+	}
+
+	if err := c.index.Lock(); err != nil {
+		c.error(err)
+		return
+	}
+	defer c.index.Unlock()
+	c.erase([]string{name})
+	c.index.Remove(name)
+	if c.shardLevels > 0 {
+		c.dropFlat(key)
+	}
+}
+
+// GC removes the responses that have expired from disk, and returns how many were
+// removed. It does nothing for a Cache made without NewWithOptions.
+func (c *Cache) GC() int {
+	if c.index == nil {
+		return 0
+	}
+	if err := c.index.Lock(); err != nil {
+		c.error(err)
+		return 0
+	}
+	defer c.index.Unlock()
+	expired := c.index.RemoveExpired()
+	c.erase(expired)
+	return len(expired)
+}
+
+// StartJanitor starts a goroutine that calls GC every interval, and returns a function
+// that stops it. Without a janitor, expired responses stay on disk until they are
+// replaced, deleted or evicted, or GC is called.
+func (c *Cache) StartJanitor(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				c.GC()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		// So that the Cache can be closed once stop returns
+		<-stopped
+	}
+}
+
+// Size returns the total size in bytes of the responses stored on disk, as tracked by
+// the index. It is zero for a Cache made without NewWithOptions.
+func (c *Cache) Size() int64 {
+	if c.index == nil {
+		return 0
+	}
+	if err := c.index.Lock(); err != nil {
+		c.error(err)
+		return 0
+	}
+	defer c.index.Unlock()
+	return c.index.Size()
+}
+
+// Close releases the index file of a Cache made with NewWithOptions. The Cache mustn't
+// be used afterwards.
+func (c *Cache) Close() error {
+	if c.index == nil {
+		return nil
+	}
+	return c.index.Close()
+}
+
+// erase removes the files of the responses names, which may have been removed already,
+// and their sidecars.
+func (c *Cache) erase(names []string) {
+	for _, name := range names {
+		if c.sidecars {
+			// First, so that the directory is empty once the response is gone
+			c.removeSidecar(name)
+		}
+		if err := c.d.Erase(name); err != nil && !os.IsNotExist(err) {
+			c.error(err)
+		}
+	}
+}
+
+// error reports an error that can't be returned.
+func (c *Cache) error(err error) {
+	if c.onError != nil {
+		c.onError(err)
+	} else {
+		log.Printf("diskcache: %v", err)
+	}
 }
 
 func keyToFilename(key string) string {
@@ -44,18 +350,63 @@ func keyToFilename(key string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// New returns a new Cache that will store files in basePath
+// New returns a new Cache that will store files in basePath.
+//
+// The Cache keeps up to 100MB of responses in memory, where it doesn't see the writes
+// of other processes, so a directory shared between processes should be used with
+// NewWithOptions instead.
 func New(basePath string) *Cache {
 	return &Cache{
 		d: diskv.New(diskv.Options{
 			BasePath:     basePath,
+			TempDir:      filepath.Join(basePath, tempDirName),
 			CacheSizeMax: 100 * 1024 * 1024, // 100MB
 		}),
 	}
 }
 
+// tempDirName is the directory in the cache directory where responses are written
+// before they are moved into place.
+const tempDirName = ".tmp"
+
+// NewWithOptions returns a new Cache that will store files in basePath, configured by
+// opts. It fails if the index can't be loaded or rebuilt.
+func NewWithOptions(basePath string, opts Options) (*Cache, error) {
+	if opts.ShardLevels < 0 || opts.ShardLevels > maxShardLevels {
+		return nil, fmt.Errorf("diskcache: ShardLevels %d isn't between 0 and %d", opts.ShardLevels, maxShardLevels)
+	}
+	idx, err := openIndex(basePath)
+	if err != nil {
+		return nil, err
+	}
+	// Without an in-memory cache, which wouldn't see the writes of other processes
+	dopts := diskv.Options{BasePath: basePath}
+	if opts.ShardLevels > 0 {
+		dopts.Transform = shardTransform(opts.ShardLevels)
+	}
+	c := &Cache{
+		d:           diskv.New(dopts),
+		maxSize:     opts.MaxSize,
+		index:       idx,
+		noSync:      opts.NoSync,
+		onError:     opts.OnError,
+		shardLevels: opts.ShardLevels,
+		sidecars:    opts.Sidecars,
+	}
+	if opts.MaxSize > 0 {
+		// The limit may have been lowered since the responses were stored
+		if err := idx.Lock(); err != nil {
+			idx.Close()
+			return nil, err
+		}
+		c.erase(idx.Evict(opts.MaxSize))
+		idx.Unlock()
+	}
+	return c, nil
+}
+
 // NewWithDiskv returns a new Cache using the provided Diskv as underlying
 // storage.
 func NewWithDiskv(d *diskv.Diskv) *Cache {
-	return &Cache{d}
+	return &Cache{d: d}
 }
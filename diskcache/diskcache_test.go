@@ -2,11 +2,25 @@ package diskcache
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gregjones/httpcache"
 )
 
+// Cache records the expiry times Transport passes to it, and returns them so that
+// TieredCache can keep them when it copies a response between tiers.
+var _ httpcache.ExpiryGetter = (*Cache)(nil)
+
 func TestDiskCache(t *testing.T) {
 	tempDir, err := ioutil.TempDir("", "httpcache")
 	if err != nil {
@@ -40,3 +54,587 @@ func TestDiskCache(t *testing.T) {
 		t.Fatal("deleted key still present")
 	}
 }
+
+func TestDiskCacheMaxSize(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache, err := NewWithOptions(tempDir, Options{MaxSize: 30})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	cache.Set("a", make([]byte, 10))
+	cache.Set("b", make([]byte, 10))
+	cache.Set("c", make([]byte, 10))
+	cache.Get("a") // b is now the least recently used
+	cache.Set("d", make([]byte, 10))
+
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("least recently used entry wasn't evicted")
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, keyToFilename("b"))); !os.IsNotExist(err) {
+		t.Fatalf("evicted entry's file wasn't removed: %v", err)
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Fatalf("%q was evicted", key)
+		}
+	}
+	if got := cache.Size(); got != 30 {
+		t.Fatalf("got size %d, want 30", got)
+	}
+	cache.Delete("d")
+	if got := cache.Size(); got != 20 {
+		t.Fatalf("got size %d after Delete, want 20", got)
+	}
+	cache.Close()
+
+	// The index survives a restart: c was used after a, so a goes first
+	cache, err = NewWithOptions(tempDir, Options{MaxSize: 30})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	if got := cache.Size(); got != 20 {
+		t.Fatalf("got size %d after restart, want 20", got)
+	}
+	cache.Set("e", make([]byte, 15))
+	if _, ok := cache.Get("a"); ok {
+		t.Fatal("least recently used entry wasn't evicted after restart")
+	}
+	if _, ok := cache.Get("c"); !ok {
+		t.Fatal("recently used entry was evicted after restart")
+	}
+	cache.Close()
+
+	// Lowering the limit evicts at once
+	cache, err = NewWithOptions(tempDir, Options{MaxSize: 15})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	defer cache.Close()
+	if _, ok := cache.Get("e"); ok {
+		t.Fatal("least recently used entry wasn't evicted for the lower limit")
+	}
+	if got := cache.Size(); got != 10 {
+		t.Fatalf("got size %d, want 10", got)
+	}
+	if _, ok := cache.Get("c"); !ok {
+		t.Fatal("most recently used entry was evicted for the lower limit")
+	}
+}
+
+func TestDiskCacheIndexRebuild(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Responses stored without an index are picked up from the directory
+	old := New(tempDir)
+	old.Set("a", make([]byte, 10))
+	old.Set("b", make([]byte, 10))
+	cache, err := NewWithOptions(tempDir, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	if got := cache.Size(); got != 20 {
+		t.Fatalf("got size %d, want 20", got)
+	}
+	cache.Close()
+
+	// As is a damaged index, once it's removed
+	if err := ioutil.WriteFile(filepath.Join(tempDir, indexName), []byte("set x\nget\ndel\nset y 5 z\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cache, err = NewWithOptions(tempDir, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	if got := cache.Size(); got != 0 {
+		t.Fatalf("got size %d from a damaged index, want 0", got)
+	}
+	cache.Close()
+	os.Remove(filepath.Join(tempDir, indexName))
+	cache, err = NewWithOptions(tempDir, Options{MaxSize: 100})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	defer cache.Close()
+	if got := cache.Size(); got != 20 {
+		t.Fatalf("got size %d after rebuilding, want 20", got)
+	}
+}
+
+func TestDiskCacheIndexCompaction(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache, err := NewWithOptions(tempDir, Options{MaxSize: 1000})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	for i := 0; i < 3*compactMin; i++ {
+		cache.Set("a", []byte("some bytes"))
+	}
+	cache.Close()
+
+	journal, err := ioutil.ReadFile(filepath.Join(tempDir, indexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(journal, []byte("\n")); n > compactMin+2 {
+		t.Fatalf("index wasn't compacted: %d records", n)
+	}
+	cache, err = NewWithOptions(tempDir, Options{MaxSize: 1000})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	defer cache.Close()
+	if got := cache.Size(); got != 10 {
+		t.Fatalf("got size %d after compaction, want 10", got)
+	}
+}
+
+func TestDiskCacheBatchedUses(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache, err := NewWithOptions(tempDir, Options{})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	defer cache.Close()
+	cache.Set("a", []byte("some bytes"))
+	before, err := ioutil.ReadFile(filepath.Join(tempDir, indexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := cache.Get("a"); !ok {
+			t.Fatal("could not retrieve an element we just added")
+		}
+	}
+	after, err := ioutil.ReadFile(filepath.Join(tempDir, indexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, before) {
+		t.Fatalf("Get wrote to the index:\n%s", after[len(before):])
+	}
+
+	// The uses are written out, once, by the next change
+	cache.Set("b", []byte("some bytes"))
+	after, err = ioutil.ReadFile(filepath.Join(tempDir, indexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(after[len(before):], []byte("get ")); n != 1 {
+		t.Fatalf("got %d get records, want 1", n)
+	}
+}
+
+func TestDiskCacheExpiry(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache, err := NewWithOptions(tempDir, Options{})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	cache.SetWithExpiry("dead", []byte("1"), time.Now().Add(-time.Second))
+	cache.SetWithExpiry("alive", []byte("2"), time.Now().Add(time.Hour))
+	cache.Set("forever", []byte("3"))
+	if _, ok := cache.Get("dead"); ok {
+		t.Fatal("expired response was returned")
+	}
+	cache.Close()
+
+	// Expiry times survive a restart
+	cache, err = NewWithOptions(tempDir, Options{})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	defer cache.Close()
+	if _, ok := cache.Get("dead"); ok {
+		t.Fatal("expired response was returned after restart")
+	}
+	if n := cache.GC(); n != 1 {
+		t.Fatalf("GC removed %d responses, want 1", n)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, keyToFilename("dead"))); !os.IsNotExist(err) {
+		t.Fatalf("expired response's file wasn't removed: %v", err)
+	}
+	for _, key := range []string{"alive", "forever"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Fatalf("%q isn't returned", key)
+		}
+	}
+	if n := cache.GC(); n != 0 {
+		t.Fatalf("second GC removed %d responses, want 0", n)
+	}
+}
+
+func TestDiskCacheJanitor(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache, err := NewWithOptions(tempDir, Options{})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	defer cache.Close()
+	stop := cache.StartJanitor(time.Millisecond)
+	defer stop()
+	cache.SetWithExpiry("dead", []byte("1"), time.Now())
+
+	filename := filepath.Join(tempDir, keyToFilename("dead"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("janitor didn't remove the expired response")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+}
+
+// The environment variables that make TestDiskCacheHelperProcess act as one of the
+// processes sharing a cache directory in TestDiskCacheProcesses.
+const (
+	helperDirEnv    = "DISKCACHE_HELPER_DIR"
+	helperSeedEnv   = "DISKCACHE_HELPER_SEED"
+	helperLevelsEnv = "DISKCACHE_HELPER_LEVELS"
+)
+
+const (
+	helperMaxSize = 2000
+	helperKeys    = 20
+	helperOps     = 300
+)
+
+// helperValue returns a value for key, of a length given by n, that Get can check
+// was stored whole.
+func helperValue(key string, n int) []byte {
+	return []byte(fmt.Sprintf("%s:%d:%s", key, n, strings.Repeat("x", n)))
+}
+
+// checkHelperValue reports whether val is a whole value returned by helperValue for
+// key.
+func checkHelperValue(key string, val []byte) bool {
+	parts := strings.SplitN(string(val), ":", 3)
+	if len(parts) != 3 || parts[0] != key {
+		return false
+	}
+	n, err := strconv.Atoi(parts[1])
+	return err == nil && parts[2] == strings.Repeat("x", n)
+}
+
+func TestDiskCacheHelperProcess(t *testing.T) {
+	dir := os.Getenv(helperDirEnv)
+	if dir == "" {
+		return
+	}
+	seed, _ := strconv.ParseInt(os.Getenv(helperSeedEnv), 10, 64)
+	levels, _ := strconv.Atoi(os.Getenv(helperLevelsEnv))
+	rnd := rand.New(rand.NewSource(seed))
+
+	cache, err := NewWithOptions(dir, Options{
+		MaxSize:     helperMaxSize,
+		NoSync:      true,
+		OnError:     func(err error) { t.Error(err) },
+		ShardLevels: levels,
+	})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	defer cache.Close()
+	for i := 0; i < helperOps; i++ {
+		key := fmt.Sprintf("key%d", rnd.Intn(helperKeys))
+		switch rnd.Intn(10) {
+		case 0:
+			cache.Delete(key)
+		case 1, 2, 3, 4:
+			cache.Set(key, helperValue(key, rnd.Intn(300)))
+		default:
+			if val, ok := cache.Get(key); ok && !checkHelperValue(key, val) {
+				t.Fatalf("got a partial or foreign value for %s: %q", key, val)
+			}
+		}
+	}
+	if size := cache.Size(); size > helperMaxSize {
+		t.Fatalf("got size %d, want at most %d", size, helperMaxSize)
+	}
+}
+
+func TestDiskCacheProcesses(t *testing.T) {
+	if os.Getenv(helperDirEnv) != "" {
+		return
+	}
+	for _, levels := range []int{0, 2} {
+		testDiskCacheProcesses(t, levels)
+	}
+}
+
+func testDiskCacheProcesses(t *testing.T, levels int) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	const processes = 4
+	cmds := make([]*exec.Cmd, processes)
+	outputs := make([]bytes.Buffer, processes)
+	for i := range cmds {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDiskCacheHelperProcess$")
+		cmd.Env = append(os.Environ(),
+			helperDirEnv+"="+tempDir,
+			helperSeedEnv+"="+strconv.Itoa(i),
+			helperLevelsEnv+"="+strconv.Itoa(levels))
+		cmd.Stdout, cmd.Stderr = &outputs[i], &outputs[i]
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		cmds[i] = cmd
+	}
+	for i, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("levels %d, process %d: %v\n%s", levels, i, err, outputs[i].Bytes())
+		}
+	}
+
+	// The index agrees with the files the processes left behind
+	cache, err := NewWithOptions(tempDir, Options{MaxSize: helperMaxSize, ShardLevels: levels})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	defer cache.Close()
+	if err := cache.index.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.index.Unlock()
+	var total int64
+	for name, e := range cache.index.items {
+		info, err := os.Stat(cache.path(name))
+		if err != nil {
+			t.Errorf("levels %d: indexed response: %v", levels, err)
+			continue
+		}
+		if size := e.Value.(*indexEntry).size; info.Size() != size {
+			t.Errorf("levels %d: indexed response %s has %d bytes, index says %d", levels, name, info.Size(), size)
+		}
+		total += info.Size()
+	}
+	if total > helperMaxSize {
+		t.Errorf("levels %d: got %d bytes of responses, want at most %d", levels, total, helperMaxSize)
+	}
+	filepath.Walk(tempDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() && path != tempDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := cache.index.items[info.Name()]; info.Mode().IsRegular() && (!ok || path != cache.path(info.Name())) {
+			t.Errorf("levels %d: response %s isn't indexed", levels, path)
+		}
+		return nil
+	})
+	if temps, _ := ioutil.ReadDir(filepath.Join(tempDir, tempDirName)); len(temps) != 0 {
+		t.Errorf("levels %d: %d temporary files left behind", levels, len(temps))
+	}
+}
+
+func TestDiskCacheShardedLayout(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if _, err := NewWithOptions(tempDir, Options{ShardLevels: maxShardLevels + 1}); err == nil {
+		t.Fatal("too many ShardLevels were accepted")
+	}
+
+	var errs []error
+	cache, err := NewWithOptions(tempDir, Options{
+		ShardLevels: 2,
+		OnError:     func(err error) { errs = append(errs, err) },
+	})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	defer cache.Close()
+	val := []byte("some bytes")
+	cache.Set("a", val)
+	name := shardedName("a")
+	stored, err := ioutil.ReadFile(filepath.Join(tempDir, name[0:2], name[2:4], name))
+	if err != nil {
+		t.Fatalf("response isn't in its shard: %v", err)
+	}
+	if want := "\"a\"\nsome bytes"; string(stored) != want {
+		t.Fatalf("got file %q, want %q", stored, want)
+	}
+	if retVal, ok := cache.Get("a"); !ok || !bytes.Equal(retVal, val) {
+		t.Fatalf("got %q, %v", retVal, ok)
+	}
+
+	// A file holding another key is a collision, not a hit
+	if err := ioutil.WriteFile(cache.path(name), encodeKey("b", val), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get("a"); ok {
+		t.Fatal("response for another key was returned")
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `for "b", not "a"`) {
+		t.Fatalf("got errors %v, want a collision", errs)
+	}
+
+	cache.Delete("a")
+	if _, err := os.Stat(filepath.Join(tempDir, name[0:2])); !os.IsNotExist(err) {
+		t.Fatalf("empty shard wasn't removed: %v", err)
+	}
+}
+
+func TestDiskCacheMigration(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Stored without an index, and then with one
+	New(tempDir).Set("d", []byte("4"))
+	flat, err := NewWithOptions(tempDir, Options{})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	flat.SetWithExpiry("a", []byte("1"), time.Now().Add(time.Hour))
+	flat.Set("b", []byte("2"))
+	flat.Set("c", []byte("3"))
+	flat.Close()
+
+	cache, err := NewWithOptions(tempDir, Options{ShardLevels: 1})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	defer cache.Close()
+	for key, want := range map[string]string{"a": "1", "d": "4"} {
+		if retVal, ok := cache.Get(key); !ok || string(retVal) != want {
+			t.Fatalf("%s: got %q, %v from the flat layout", key, retVal, ok)
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, keyToFilename(key))); !os.IsNotExist(err) {
+			t.Fatalf("%s: flat file wasn't removed: %v", key, err)
+		}
+		if _, err := os.Stat(cache.path(shardedName(key))); err != nil {
+			t.Fatalf("%s: response wasn't moved: %v", key, err)
+		}
+	}
+	if err := cache.index.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if e := cache.index.items[shardedName("a")]; e == nil || e.Value.(*indexEntry).expires == 0 {
+		t.Error("expiry time wasn't kept")
+	}
+	cache.index.Unlock()
+
+	// Replacing or deleting a response drops its flat file
+	cache.Set("b", []byte("5"))
+	cache.Delete("c")
+	for _, key := range []string{"b", "c"} {
+		if _, err := os.Stat(filepath.Join(tempDir, keyToFilename(key))); !os.IsNotExist(err) {
+			t.Fatalf("%s: flat file wasn't removed: %v", key, err)
+		}
+	}
+	if retVal, ok := cache.Get("b"); !ok || string(retVal) != "5" {
+		t.Fatalf("got %q, %v for the replaced response", retVal, ok)
+	}
+	if _, ok := cache.Get("c"); ok {
+		t.Fatal("deleted response was returned")
+	}
+}
+
+func TestDiskCacheSidecars(t *testing.T) {
+	for _, levels := range []int{0, 2} {
+		tempDir, err := ioutil.TempDir("", "httpcache")
+		if err != nil {
+			t.Fatalf("TempDir: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		cache, err := NewWithOptions(tempDir, Options{MaxSize: 200, ShardLevels: levels, Sidecars: true})
+		if err != nil {
+			t.Fatalf("NewWithOptions: %v", err)
+		}
+		key := "http://somewhere.com/"
+		resp := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nsome bytes")
+		expires := time.Now().Add(time.Hour)
+		cache.SetWithExpiry(key, resp, expires)
+
+		filename := cache.Filename(key)
+		if _, err := os.Stat(filename); err != nil {
+			t.Fatalf("levels %d: Filename doesn't return the response's file: %v", levels, err)
+		}
+		data, err := ioutil.ReadFile(filename + sidecarExt)
+		if err != nil {
+			t.Fatalf("levels %d: no sidecar: %v", levels, err)
+		}
+		var m Metadata
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatalf("levels %d: %v", levels, err)
+		}
+		if m.Key != key || m.Status != 200 || m.ContentType != "text/plain" || m.Size != int64(len(resp)) ||
+			m.Expires == nil || !m.Expires.Equal(expires) || time.Since(m.Stored) > time.Minute {
+			t.Fatalf("levels %d: got metadata %+v", levels, m)
+		}
+
+		// Sidecars aren't taken for responses when the index is rebuilt
+		cache.Set("other", []byte("not a response"))
+		cache.Close()
+		os.Remove(filepath.Join(tempDir, indexName))
+		cache, err = NewWithOptions(tempDir, Options{MaxSize: 200, ShardLevels: levels, Sidecars: true})
+		if err != nil {
+			t.Fatalf("NewWithOptions: %v", err)
+		}
+		want := int64(len(resp) + len("not a response"))
+		if levels > 0 {
+			want += int64(len(strconv.Quote(key)) + len(`"other"`) + 2)
+		}
+		if got := cache.Size(); got != want {
+			t.Fatalf("levels %d: got size %d after rebuilding, want %d", levels, got, want)
+		}
+
+		// Evicted and deleted responses take their sidecars with them
+		cache.Set("big", make([]byte, 190))
+		cache.Delete("big")
+		for _, key := range []string{key, "other", "big"} {
+			if _, err := os.Stat(cache.Filename(key) + sidecarExt); !os.IsNotExist(err) {
+				t.Fatalf("levels %d: sidecar of %s wasn't removed: %v", levels, key, err)
+			}
+		}
+		cache.Close()
+	}
+}
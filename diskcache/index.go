@@ -0,0 +1,518 @@
+package diskcache
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexName and lockName are the names of the index and lock files in the cache
+// directory. Stored responses are named by their hex hash, so they can't clash.
+const (
+	indexName = ".index"
+	lockName  = ".lock"
+)
+
+// compactMin is the number of superseded records the index journal may hold before
+// it is rewritten.
+const compactMin = 1000
+
+// maxUses is the number of uses the index may hold before they are written out.
+const maxUses = 1000
+
+// index tracks the size, recency and expiry of every stored response, so that the
+// least recently used can be evicted when the cache grows too large, and expired ones
+// removed.
+//
+// It is kept in memory and persisted as a journal of text records, one per line,
+// appended to the index file as changes are made:
+//
+//	set <name> <size> <access time> [<expiry time>]
+//	get <name> <access time>
+//	del <name>
+//
+// Times are in Unix nanoseconds, and a missing or zero expiry time means never.
+// Replaying the journal rebuilds the index, and when it holds many superseded records
+// it is rewritten with one set record per response, least recently used first.
+//
+// Several processes may share an index. Every change to it happens between Lock and
+// Unlock, which hold an exclusive advisory lock on the lock file, and reads happen
+// between RLock and RUnlock, which hold a shared one, so that readers in different
+// processes don't wait for each other. Both first replay the records other processes
+// have appended since, or reload the index if one of them rewrote it.
+//
+// Reading a response doesn't write to the journal: its use is applied to the index in
+// memory at once, but only written out, as get records, by the next Lock, or by RUnlock
+// once maxUses have piled up. Uses not yet written out when the process dies are lost,
+// which only makes eviction a little less accurate.
+type index struct {
+	mu      sync.Mutex
+	dir     string
+	path    string
+	lock    *os.File
+	journal *os.File
+	offset  int64 // of the end of the last record replayed or appended
+	records int
+	size    int64
+	ll      list.List // of *indexEntry, most recently used first
+	items   map[string]*list.Element
+	uses    map[string]int64 // access times not yet in the journal
+}
+
+type indexEntry struct {
+	name    string
+	size    int64
+	atime   int64
+	expires int64
+}
+
+func (e *indexEntry) expired(now int64) bool {
+	return e.expires != 0 && e.expires <= now
+}
+
+// openIndex loads the index of the responses stored in dir, rebuilding it from the
+// files in dir if there's no index file.
+func openIndex(dir string) (*index, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockName), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	idx := &index{
+		dir:   dir,
+		path:  filepath.Join(dir, indexName),
+		lock:  lock,
+		items: map[string]*list.Element{},
+		uses:  map[string]int64{},
+	}
+	if err := idx.Lock(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	// Start from a compact journal, which also drops any record cut short by a crash
+	err = idx.compact()
+	idx.Unlock()
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Lock locks the index for changes by the calling goroutine and process, brings it up
+// to date with the index file, and writes out the uses recorded since the last Lock.
+func (idx *index) Lock() error {
+	if err := idx.lockShared(false); err != nil {
+		return err
+	}
+	for _, name := range idx.usedNames() {
+		if _, ok := idx.items[name]; ok {
+			idx.append("get %s %d\n", name, idx.uses[name])
+		}
+	}
+	idx.uses = map[string]int64{}
+	return nil
+}
+
+// Unlock unlocks the index.
+func (idx *index) Unlock() {
+	unlockFile(idx.lock)
+	idx.mu.Unlock()
+}
+
+// RLock locks the index for reading by the calling goroutine, while other processes
+// may read it too, and brings it up to date with the index file. If the index file
+// has to be rebuilt, it is locked for changes instead.
+func (idx *index) RLock() error {
+	err := idx.lockShared(true)
+	if err == errRebuild {
+		return idx.Lock()
+	}
+	return err
+}
+
+// RUnlock unlocks the index after RLock, and writes out the uses recorded since the
+// last Lock if there are many of them.
+func (idx *index) RUnlock() {
+	flush := len(idx.uses) >= maxUses
+	idx.Unlock()
+	if flush && idx.Lock() == nil {
+		idx.Unlock()
+	}
+}
+
+// errRebuild is returned by sync when the index file has to be rebuilt, which can't
+// be done under a shared lock.
+var errRebuild = errors.New("diskcache: index file has to be rebuilt")
+
+// lockShared locks idx for the calling goroutine, and the lock file with a shared or
+// exclusive lock, and brings idx up to date with the index file.
+func (idx *index) lockShared(shared bool) error {
+	idx.mu.Lock()
+	if idx.lock == nil {
+		idx.mu.Unlock()
+		return os.ErrClosed
+	}
+	lock := lockFile
+	if shared {
+		lock = lockFileShared
+	}
+	if err := lock(idx.lock); err != nil {
+		idx.mu.Unlock()
+		return err
+	}
+	if err := idx.sync(shared); err != nil {
+		unlockFile(idx.lock)
+		idx.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// sync brings idx up to date with the index file: it replays records appended since
+// it was last read, or reloads it if the file was replaced, or rebuilds it from the
+// stored files if there's no index file, unless the lock is shared, when it returns
+// errRebuild instead.
+func (idx *index) sync(shared bool) error {
+	info, err := os.Stat(idx.path)
+	if os.IsNotExist(err) {
+		if shared {
+			return errRebuild
+		}
+		idx.reset()
+		if err := idx.scan(); err != nil {
+			return err
+		}
+		return idx.compact()
+	}
+	if err != nil {
+		return err
+	}
+	if idx.journal != nil {
+		if journalInfo, err := idx.journal.Stat(); err != nil || !os.SameFile(info, journalInfo) {
+			idx.reset()
+		}
+	}
+	if idx.journal == nil {
+		journal, err := os.OpenFile(idx.path, os.O_RDWR|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		idx.reset()
+		idx.journal = journal
+	}
+	if info.Size() > idx.offset {
+		idx.replay(io.NewSectionReader(idx.journal, idx.offset, info.Size()-idx.offset))
+		// Uses not yet written out may have been overtaken, or forgotten by a reload
+		for _, name := range idx.usedNames() {
+			if e, ok := idx.items[name]; ok && e.Value.(*indexEntry).atime < idx.uses[name] {
+				idx.get(name, idx.uses[name])
+			}
+		}
+	}
+	return nil
+}
+
+// usedNames returns the names of the responses used since the last Lock, least
+// recently used first, the order in which their uses have to be applied.
+func (idx *index) usedNames() []string {
+	names := make([]string, 0, len(idx.uses))
+	for name := range idx.uses {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return idx.uses[names[i]] < idx.uses[names[j]] })
+	return names
+}
+
+// reset empties idx and forgets the journal.
+func (idx *index) reset() {
+	if idx.journal != nil {
+		idx.journal.Close()
+		idx.journal = nil
+	}
+	idx.offset, idx.records, idx.size = 0, 0, 0
+	idx.ll.Init()
+	idx.items = map[string]*list.Element{}
+}
+
+// replay applies the complete records in r to idx, advancing idx.offset past them.
+// Records that can't be parsed, such as one cut short by a crash, are skipped.
+func (idx *index) replay(r io.Reader) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			// An incomplete record is left for the next replay
+			return
+		}
+		idx.offset += int64(len(line))
+		idx.records++
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch {
+		case fields[0] == "set" && len(fields) >= 4:
+			size, err1 := strconv.ParseInt(fields[2], 10, 64)
+			atime, err2 := strconv.ParseInt(fields[3], 10, 64)
+			var expires int64
+			if len(fields) >= 5 {
+				expires, _ = strconv.ParseInt(fields[4], 10, 64)
+			}
+			if err1 == nil && err2 == nil {
+				idx.set(fields[1], size, atime, expires)
+			}
+		case fields[0] == "get" && len(fields) >= 3:
+			if atime, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+				idx.get(fields[1], atime)
+			}
+		case fields[0] == "del":
+			idx.del(fields[1])
+		}
+	}
+}
+
+// scan adds every response file in the cache directory and its subdirectories to idx,
+// taking modification times as access times.
+func (idx *index) scan() error {
+	var infos []os.FileInfo
+	err := filepath.Walk(idx.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		hidden := strings.HasPrefix(info.Name(), ".")
+		if info.IsDir() && hidden && path != idx.dir {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && !hidden && !isSidecar(info.Name()) {
+			infos = append(infos, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		idx.set(info.Name(), info.Size(), info.ModTime().UnixNano(), 0)
+	}
+	return nil
+}
+
+// set records a response name of size bytes, used at atime and expiring at expires.
+func (idx *index) set(name string, size, atime, expires int64) {
+	idx.del(name)
+	idx.items[name] = idx.ll.PushFront(&indexEntry{name: name, size: size, atime: atime, expires: expires})
+	idx.size += size
+}
+
+// get records a use of the response name at atime.
+func (idx *index) get(name string, atime int64) {
+	if e, ok := idx.items[name]; ok {
+		e.Value.(*indexEntry).atime = atime
+		idx.ll.MoveToFront(e)
+	}
+}
+
+// del removes the response name.
+func (idx *index) del(name string) {
+	if e, ok := idx.items[name]; ok {
+		idx.size -= e.Value.(*indexEntry).size
+		idx.ll.Remove(e)
+		delete(idx.items, name)
+	}
+}
+
+// The methods below that change the index must be called between Lock and Unlock, and
+// the others between either those or RLock and RUnlock.
+
+// Add records that the response name of size bytes was stored, expiring at expires
+// unless that is zero.
+func (idx *index) Add(name string, size int64, expires time.Time) {
+	now := time.Now().UnixNano()
+	var exp int64
+	if !expires.IsZero() {
+		exp = expires.UnixNano()
+	}
+	idx.set(name, size, now, exp)
+	idx.append("set %s %d %d %d\n", name, size, now, exp)
+}
+
+// Use records that the response name was read, unless it has expired, and reports
+// whether it has. The use is written out later, so Use may be called under RLock.
+func (idx *index) Use(name string) (expired bool) {
+	e, ok := idx.items[name]
+	if !ok {
+		return false
+	}
+	now := time.Now().UnixNano()
+	if e.Value.(*indexEntry).expired(now) {
+		return true
+	}
+	idx.get(name, now)
+	idx.uses[name] = now
+	return false
+}
+
+// Has reports whether the response name is in the index.
+func (idx *index) Has(name string) bool {
+	_, ok := idx.items[name]
+	return ok
+}
+
+// Expiry returns the expiry time of the response name, or zero if it never expires or
+// isn't in the index.
+func (idx *index) Expiry(name string) time.Time {
+	e, ok := idx.items[name]
+	if !ok || e.Value.(*indexEntry).expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, e.Value.(*indexEntry).expires)
+}
+
+// Rename records that the response old was moved to the file new, where it takes size
+// bytes, keeping its access and expiry times.
+func (idx *index) Rename(old, new string, size int64) {
+	e, ok := idx.items[old]
+	if !ok {
+		return
+	}
+	entry := e.Value.(*indexEntry)
+	idx.del(old)
+	idx.set(new, size, entry.atime, entry.expires)
+	idx.append("set %s %d %d %d\n", new, size, entry.atime, entry.expires)
+	idx.append("del %s\n", old)
+}
+
+// Remove records that the response name was removed.
+func (idx *index) Remove(name string) {
+	if _, ok := idx.items[name]; !ok {
+		return
+	}
+	idx.del(name)
+	idx.append("del %s\n", name)
+}
+
+// Evict removes the least recently used responses from the index until their total
+// size is at most maxSize, and returns their names so their files can be removed.
+func (idx *index) Evict(maxSize int64) []string {
+	var evicted []string
+	for idx.size > maxSize && idx.ll.Len() > 0 {
+		name := idx.ll.Back().Value.(*indexEntry).name
+		idx.del(name)
+		idx.append("del %s\n", name)
+		evicted = append(evicted, name)
+	}
+	return evicted
+}
+
+// RemoveExpired removes the responses that have expired from the index, and returns
+// their names so their files can be removed.
+func (idx *index) RemoveExpired() []string {
+	now := time.Now().UnixNano()
+	var expired []string
+	for e := idx.ll.Front(); e != nil; {
+		entry := e.Value.(*indexEntry)
+		e = e.Next()
+		if entry.expired(now) {
+			idx.del(entry.name)
+			idx.append("del %s\n", entry.name)
+			expired = append(expired, entry.name)
+		}
+	}
+	return expired
+}
+
+// Size returns the total size of the responses in the index.
+func (idx *index) Size() int64 {
+	return idx.size
+}
+
+// append writes a record to the journal, compacting it if it has grown too long. The
+// index works from memory, so a failed write only costs accuracy after a restart.
+func (idx *index) append(format string, args ...interface{}) {
+	if idx.journal == nil {
+		return
+	}
+	n, err := fmt.Fprintf(idx.journal, format, args...)
+	if err != nil {
+		// Whatever was written is replayed by the next Lock
+		return
+	}
+	idx.offset += int64(n)
+	idx.records++
+	if idx.records > 2*len(idx.items)+compactMin {
+		idx.compact()
+	}
+}
+
+// compact rewrites the journal with a single record for each response, least recently
+// used first, and replaces the index file with it.
+func (idx *index) compact() error {
+	var buf bytes.Buffer
+	for e := idx.ll.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*indexEntry)
+		fmt.Fprintf(&buf, "set %s %d %d %d\n", entry.name, entry.size, entry.atime, entry.expires)
+	}
+	tmp, err := ioutil.TempFile(idx.dir, indexName+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), idx.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	journal, err := os.OpenFile(idx.path, os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if idx.journal != nil {
+		idx.journal.Close()
+	}
+	idx.journal = journal
+	idx.offset = int64(buf.Len())
+	idx.records = idx.ll.Len()
+	return nil
+}
+
+// Close writes out the uses recorded since the last Lock, and closes the index files.
+func (idx *index) Close() error {
+	if idx.Lock() == nil {
+		idx.Unlock()
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	var err error
+	if idx.journal != nil {
+		err = idx.journal.Close()
+		idx.journal = nil
+	}
+	if idx.lock != nil {
+		if lockErr := idx.lock.Close(); err == nil {
+			err = lockErr
+		}
+		idx.lock = nil
+	}
+	return err
+}
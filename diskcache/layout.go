@@ -0,0 +1,126 @@
+package diskcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// maxShardLevels is the most levels of subdirectories the sharded layout may use.
+// Even at a billion responses, four levels leave only a few in each directory.
+const maxShardLevels = 4
+
+// shardedName returns the name of the file holding the response for key in the
+// sharded layout: the SHA-256 of key in hex.
+func shardedName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// shardTransform returns the diskv Transform of the sharded layout with levels levels
+// of subdirectories, each named by the next byte of the file name. Files with other
+// names, such as those of the flat layout, stay in the cache directory itself.
+func shardTransform(levels int) func(string) []string {
+	return func(name string) []string {
+		if len(name) != 2*sha256.Size {
+			return []string{}
+		}
+		dirs := make([]string, levels)
+		for i := range dirs {
+			dirs[i] = name[2*i : 2*i+2]
+		}
+		return dirs
+	}
+}
+
+// encodeKey returns the contents of the file holding resp for key in the sharded
+// layout: key, quoted, on a line of its own, followed by resp.
+func encodeKey(key string, resp []byte) []byte {
+	quoted := strconv.Quote(key)
+	stored := make([]byte, 0, len(quoted)+1+len(resp))
+	return append(append(append(stored, quoted...), '\n'), resp...)
+}
+
+// decodeKey returns the key and the response held in a file of the sharded layout.
+func decodeKey(stored []byte) (key string, resp []byte, err error) {
+	i := bytes.IndexByte(stored, '\n')
+	if i < 0 {
+		return "", nil, fmt.Errorf("no key in %d bytes", len(stored))
+	}
+	key, err = strconv.Unquote(string(stored[:i]))
+	if err != nil {
+		return "", nil, fmt.Errorf("bad key %.40q: %v", stored[:i], err)
+	}
+	return key, stored[i+1:], nil
+}
+
+// name returns the name of the file holding the response for key.
+func (c *Cache) name(key string) string {
+	if c.shardLevels > 0 {
+		return shardedName(key)
+	}
+	return keyToFilename(key)
+}
+
+// path returns the path of the file of the response name.
+func (c *Cache) path(name string) string {
+	return filepath.Join(c.d.BasePath, filepath.Join(c.d.Transform(name)...), name)
+}
+
+// place moves the temporary file tmp to path, creating its directory if need be, or
+// removes it if it can't. c.index must be locked.
+func (c *Cache) place(tmp, path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// migrate moves the response for key from the file named name in the flat layout,
+// if there is one, to its file in the sharded layout. c.index must be locked.
+func (c *Cache) migrate(key, name string) {
+	flat := keyToFilename(key)
+	if !c.index.Has(flat) || c.index.Has(name) {
+		return
+	}
+	resp, err := c.d.Read(flat)
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.index.Remove(flat)
+		} else {
+			c.error(err)
+		}
+		return
+	}
+	stored := encodeKey(key, resp)
+	tmp, err := c.writeTemp(stored)
+	if err == nil {
+		err = c.place(tmp, c.path(name))
+	}
+	if err != nil {
+		c.error(err)
+		return
+	}
+	if c.sidecars {
+		c.writeSidecar(key, name, resp, c.index.Expiry(flat))
+	}
+	c.index.Rename(flat, name, int64(len(stored)))
+	c.erase([]string{flat})
+}
+
+// dropFlat removes the response for key stored in the flat layout, if any, which
+// the response in the sharded layout supersedes. c.index must be locked.
+func (c *Cache) dropFlat(key string) {
+	if flat := keyToFilename(key); c.index.Has(flat) {
+		c.erase([]string{flat})
+		c.index.Remove(flat)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package diskcache
+
+import "os"
+
+// lockFile does nothing where advisory file locks aren't supported, so a cache
+// directory mustn't be shared between processes there.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// lockFileShared does nothing.
+func lockFileShared(f *os.File) error {
+	return nil
+}
+
+// unlockFile does nothing.
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package diskcache
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive advisory lock on f, waiting for other processes to
+// release it.
+func lockFile(f *os.File) error {
+	return flock(f, syscall.LOCK_EX)
+}
+
+// lockFileShared takes a shared advisory lock on f, waiting for a process holding an
+// exclusive one to release it.
+func lockFileShared(f *os.File) error {
+	return flock(f, syscall.LOCK_SH)
+}
+
+func flock(f *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// unlockFile releases the lock on f.
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
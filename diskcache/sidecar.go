@@ -0,0 +1,80 @@
+package diskcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// sidecarExt is appended to the name of the file of a response to name its sidecar.
+const sidecarExt = ".json"
+
+// Metadata describes a stored response. With Options.Sidecars, it's written as JSON
+// next to the file of the response, in a file of the same name ending in .json.
+type Metadata struct {
+	// Key is the key the response was stored under, which Transport makes the
+	// URL of the request.
+	Key string `json:"key"`
+
+	Stored      time.Time  `json:"stored"`
+	Status      int        `json:"status,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	Size        int64      `json:"size"`
+	Expires     *time.Time `json:"expires,omitempty"`
+}
+
+// newMetadata returns the metadata of resp, stored for key now and expiring at
+// expires unless that is zero. The status and content type are left out if resp
+// isn't an HTTP response.
+func newMetadata(key string, resp []byte, expires time.Time) *Metadata {
+	m := &Metadata{Key: key, Stored: time.Now().UTC(), Size: int64(len(resp))}
+	if !expires.IsZero() {
+		utc := expires.UTC()
+		m.Expires = &utc
+	}
+	if r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), nil); err == nil {
+		r.Body.Close()
+		m.Status = r.StatusCode
+		m.ContentType = r.Header.Get("Content-Type")
+	}
+	return m
+}
+
+// Filename returns the path of the file that holds the response for key, if there
+// is one. With Options.Sidecars, its metadata is in the same path ending in .json.
+func (c *Cache) Filename(key string) string {
+	return c.path(c.name(key))
+}
+
+// writeSidecar writes the metadata of the response resp for key, stored in the file
+// name, to its sidecar. c.index must be locked.
+func (c *Cache) writeSidecar(key, name string, resp []byte, expires time.Time) {
+	data, err := json.MarshalIndent(newMetadata(key, resp, expires), "", "\t")
+	if err != nil {
+		c.error(err)
+		return
+	}
+	tmp, err := c.writeTemp(append(data, '\n'))
+	if err == nil {
+		err = c.place(tmp, c.path(name)+sidecarExt)
+	}
+	if err != nil {
+		c.error(err)
+	}
+}
+
+// removeSidecar removes the sidecar of the response name, if it has one.
+func (c *Cache) removeSidecar(name string) {
+	if err := os.Remove(c.path(name) + sidecarExt); err != nil && !os.IsNotExist(err) {
+		c.error(err)
+	}
+}
+
+// isSidecar reports whether the file name is a sidecar rather than a response.
+func isSidecar(name string) bool {
+	return strings.HasSuffix(name, sidecarExt)
+}
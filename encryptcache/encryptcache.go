@@ -0,0 +1,187 @@
+// Package encryptcache provides an implementation of httpcache.Cache that encrypts
+// responses with AES-GCM before storing them in another Cache, so that responses
+// written to disk or sent to a shared server such as memcache can't be read or
+// altered without the key.
+//
+// Each entry records the ID of the key that encrypted it, so keys can be rotated:
+// entries encrypted with a previous key are still readable, and are re-encrypted with
+// the current key when read, unless the entry was replaced in the meantime. The cache
+// key is authenticated along with the response, so an entry copied to another key
+// isn't accepted either. Any entry that fails authentication is treated as missing.
+package encryptcache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gregjones/httpcache"
+)
+
+// A Key is an AES key and the ID it is stored under. Secret must be 16, 24 or 32 bytes
+// long, to select AES-128, AES-192 or AES-256.
+type Key struct {
+	ID     uint32
+	Secret []byte
+}
+
+// Cache is an implementation of httpcache.Cache that encrypts responses before
+// storing them in an underlying Cache.
+type Cache struct {
+	// KeyHMAC, if non-nil, is a secret used to replace each cache key by its
+	// HMAC-SHA256 before it reaches the underlying cache, so that the URLs of cached
+	// responses aren't visible there either. It must be set before the cache is used.
+	KeyHMAC []byte
+
+	cache   httpcache.Cache
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+
+	// mu serialises writes, so that re-encrypting an entry can't overwrite a newer
+	// one stored by Set, or bring back a deleted one. Writes by other Caches sharing
+	// the underlying cache aren't covered.
+	mu sync.Mutex
+}
+
+const idSize = 4
+
+// New returns a new Cache that stores entries in cache, encrypted with current.
+// Entries encrypted with any of the previous keys can also be read.
+func New(cache httpcache.Cache, current Key, previous ...Key) (*Cache, error) {
+	c := &Cache{cache: cache, current: current.ID, aeads: map[uint32]cipher.AEAD{}}
+	for _, key := range append([]Key{current}, previous...) {
+		if _, ok := c.aeads[key.ID]; ok {
+			return nil, fmt.Errorf("encryptcache: key ID %d is used more than once", key.ID)
+		}
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		c.aeads[key.ID] = aead
+	}
+	return c, nil
+}
+
+// Get returns the response corresponding to key, decrypted, if present and authentic
+func (c *Cache) Get(key string) (resp []byte, ok bool) {
+	resp, _, ok = c.GetWithExpiry(key)
+	return resp, ok
+}
+
+// GetWithExpiry returns the response corresponding to key, decrypted, if present and
+// authentic, and the time it expires if the underlying cache is an
+// httpcache.ExpiryGetter
+func (c *Cache) GetWithExpiry(key string) (resp []byte, expires time.Time, ok bool) {
+	storedKey := c.storedKey(key)
+	stored, expires, ok := c.getStored(storedKey)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	resp, id, err := c.open(key, stored)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	if id != c.current {
+		c.mu.Lock()
+		// Only if the entry is still the one that was read
+		if again, _, ok := c.getStored(storedKey); ok && bytes.Equal(again, stored) {
+			c.seal(storedKey, key, resp, expires)
+		}
+		c.mu.Unlock()
+	}
+	return resp, expires, true
+}
+
+// Set saves a response to the cache as key, encrypted with the current key
+func (c *Cache) Set(key string, resp []byte) {
+	c.SetWithExpiry(key, resp, time.Time{})
+}
+
+// SetWithExpiry saves a response to the cache as key, encrypted with the current key,
+// until expires if the underlying cache is an httpcache.ExpiringCache
+func (c *Cache) SetWithExpiry(key string, resp []byte, expires time.Time) {
+	c.mu.Lock()
+	c.seal(c.storedKey(key), key, resp, expires)
+	c.mu.Unlock()
+}
+
+// Delete removes the response with key from the cache
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	c.cache.Delete(c.storedKey(key))
+	c.mu.Unlock()
+}
+
+// getStored returns the entry stored under storedKey, and its expiry time if the
+// underlying cache is an httpcache.ExpiryGetter.
+func (c *Cache) getStored(storedKey string) (stored []byte, expires time.Time, ok bool) {
+	if eg, isGetter := c.cache.(httpcache.ExpiryGetter); isGetter {
+		return eg.GetWithExpiry(storedKey)
+	}
+	stored, ok = c.cache.Get(storedKey)
+	return stored, time.Time{}, ok
+}
+
+// storedKey returns the key under which key's entry is stored in the underlying cache.
+func (c *Cache) storedKey(key string) string {
+	if c.KeyHMAC == nil {
+		return key
+	}
+	mac := hmac.New(sha256.New, c.KeyHMAC)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts resp with the current key and stores it under storedKey until expires,
+// or indefinitely if that is zero. An entry is the key ID, the nonce and the sealed
+// response, authenticated with key. c.mu must be held.
+func (c *Cache) seal(storedKey, key string, resp []byte, expires time.Time) {
+	aead := c.aeads[c.current]
+	stored := make([]byte, idSize+aead.NonceSize(), idSize+aead.NonceSize()+len(resp)+aead.Overhead())
+	binary.BigEndian.PutUint32(stored, c.current)
+	if _, err := rand.Read(stored[idSize:]); err != nil {
+		// Without a nonce nothing can be stored safely, so drop any older entry
+		c.cache.Delete(storedKey)
+		return
+	}
+	stored = aead.Seal(stored, stored[idSize:], resp, []byte(key))
+	if ec, ok := c.cache.(httpcache.ExpiringCache); ok {
+		ec.SetWithExpiry(storedKey, stored, expires)
+	} else {
+		c.cache.Set(storedKey, stored)
+	}
+}
+
+var errInvalid = errors.New("encryptcache: entry is invalid")
+
+// open decrypts and authenticates the entry stored for key, and returns the response
+// with the ID of the key that encrypted it.
+func (c *Cache) open(key string, stored []byte) (resp []byte, id uint32, err error) {
+	if len(stored) < idSize {
+		return nil, 0, errInvalid
+	}
+	id = binary.BigEndian.Uint32(stored)
+	aead, ok := c.aeads[id]
+	if !ok || len(stored) < idSize+aead.NonceSize()+aead.Overhead() {
+		return nil, 0, errInvalid
+	}
+	nonce := stored[idSize : idSize+aead.NonceSize()]
+	resp, err = aead.Open(nil, nonce, stored[idSize+aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp, id, nil
+}
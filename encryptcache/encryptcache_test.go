@@ -0,0 +1,218 @@
+package encryptcache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gregjones/httpcache"
+)
+
+var (
+	key1 = Key{ID: 1, Secret: bytes.Repeat([]byte{1}, 32)}
+	key2 = Key{ID: 2, Secret: bytes.Repeat([]byte{2}, 16)}
+)
+
+func TestEncryptCache(t *testing.T) {
+	underlying := httpcache.NewMemoryCache()
+	cache, err := New(underlying, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "testKey"
+	_, ok := cache.Get(key)
+	if ok {
+		t.Fatal("retrieved key before adding it")
+	}
+
+	val := []byte("some bytes")
+	cache.Set(key, val)
+
+	retVal, ok := cache.Get(key)
+	if !ok {
+		t.Fatal("could not retrieve an element we just added")
+	}
+	if !bytes.Equal(retVal, val) {
+		t.Fatal("retrieved a different value than what we put in")
+	}
+	stored, ok := underlying.Get(key)
+	if !ok || bytes.Contains(stored, val) {
+		t.Fatalf("value isn't stored encrypted: %q", stored)
+	}
+
+	cache.Delete(key)
+
+	_, ok = cache.Get(key)
+	if ok {
+		t.Fatal("deleted key still present")
+	}
+}
+
+func TestEncryptCacheKeyHMAC(t *testing.T) {
+	underlying := httpcache.NewMemoryCache()
+	cache, err := New(underlying, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.KeyHMAC = []byte("secret")
+
+	key := "http://example.com/private?token=abc"
+	cache.Set(key, []byte("some bytes"))
+	if _, ok := underlying.Get(key); ok {
+		t.Fatal("key is visible in the underlying cache")
+	}
+	if _, ok := underlying.Get(cache.storedKey(key)); !ok {
+		t.Fatal("entry isn't stored under the HMAC of the key")
+	}
+	if _, ok := cache.Get(key); !ok {
+		t.Fatal("could not retrieve an element we just added")
+	}
+	cache.Delete(key)
+	if _, ok := underlying.Get(cache.storedKey(key)); ok {
+		t.Fatal("deleted key still present")
+	}
+}
+
+func TestEncryptCacheRotation(t *testing.T) {
+	underlying := httpcache.NewMemoryCache()
+	old, err := New(underlying, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Set("key", []byte("some bytes"))
+
+	cache, err := New(underlying, key2, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retVal, ok := cache.Get("key"); !ok || string(retVal) != "some bytes" {
+		t.Fatal("entry encrypted with the previous key isn't readable")
+	}
+
+	// Reading the entry re-encrypted it with the current key, so it no longer needs
+	// the previous one
+	current, err := New(underlying, key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := current.Get("key"); !ok {
+		t.Fatal("entry wasn't re-encrypted with the current key")
+	}
+}
+
+// racingCache calls race, if set, after the next entry is read from it.
+type racingCache struct {
+	*httpcache.MemoryCache
+	race func()
+}
+
+func (c *racingCache) GetWithExpiry(key string) ([]byte, time.Time, bool) {
+	resp, expires, ok := c.MemoryCache.GetWithExpiry(key)
+	if c.race != nil {
+		race := c.race
+		c.race = nil
+		race()
+	}
+	return resp, expires, ok
+}
+
+func TestEncryptCacheRotationRace(t *testing.T) {
+	underlying := &racingCache{MemoryCache: httpcache.NewMemoryCache()}
+	old, err := New(underlying, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Set("key", []byte("old bytes"))
+
+	cache, err := New(underlying, key2, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A newer response is stored between reading the old entry and re-encrypting it
+	underlying.race = func() { cache.Set("key", []byte("new bytes")) }
+	if retVal, ok := cache.Get("key"); !ok || string(retVal) != "old bytes" {
+		t.Fatalf("got %q, want the entry that was read", retVal)
+	}
+	if retVal, ok := cache.Get("key"); !ok || string(retVal) != "new bytes" {
+		t.Fatalf("newer entry was overwritten: got %q", retVal)
+	}
+
+	// Nor is a deleted entry brought back
+	old.Set("key", []byte("old bytes"))
+	underlying.race = func() { cache.Delete("key") }
+	cache.Get("key")
+	if _, ok := cache.Get("key"); ok {
+		t.Fatal("deleted entry was re-encrypted")
+	}
+}
+
+func TestEncryptCacheAuthenticationFailure(t *testing.T) {
+	underlying := httpcache.NewMemoryCache()
+	cache, err := New(underlying, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("a", []byte("some bytes"))
+	stored, _ := underlying.Get("a")
+
+	// Copied to another key
+	underlying.Set("b", stored)
+	// Altered
+	tampered := append([]byte(nil), stored...)
+	tampered[len(tampered)-1] ^= 1
+	underlying.Set("tampered", tampered)
+	// Unknown key ID
+	unknown := append([]byte(nil), stored...)
+	unknown[3] = 9
+	underlying.Set("unknown", unknown)
+	// Truncated, and a plaintext entry from before encryption was used
+	underlying.Set("short", stored[:10])
+	underlying.Set("plaintext", []byte("HTTP/1.1 200 OK\r\n\r\n"))
+
+	for _, key := range []string{"b", "tampered", "unknown", "short", "plaintext"} {
+		if _, ok := cache.Get(key); ok {
+			t.Errorf("%s: entry failing authentication was returned", key)
+		}
+	}
+
+	// A different key with the same ID
+	other, err := New(underlying, Key{ID: 1, Secret: bytes.Repeat([]byte{3}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.Get("a"); ok {
+		t.Error("entry was decrypted with the wrong key")
+	}
+}
+
+func TestNewInvalidKeys(t *testing.T) {
+	if _, err := New(httpcache.NewMemoryCache(), Key{ID: 1, Secret: []byte("short")}); err == nil {
+		t.Error("invalid key length was accepted")
+	}
+	if _, err := New(httpcache.NewMemoryCache(), key1, Key{ID: 1, Secret: key2.Secret}); err == nil {
+		t.Error("duplicate key ID was accepted")
+	}
+}
+
+func TestEncryptCacheRotationExpiry(t *testing.T) {
+	underlying := httpcache.NewMemoryCache()
+	old, err := New(underlying, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour).Round(0)
+	old.SetWithExpiry("key", []byte("some bytes"), expires)
+
+	// Re-encrypting with a new key keeps the expiry time
+	cache, err := New(underlying, key2, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get("key"); !ok {
+		t.Fatal("response isn't returned")
+	}
+	if stored, got, _ := underlying.GetWithExpiry("key"); !got.Equal(expires) || stored[3] != byte(key2.ID) {
+		t.Fatalf("re-encrypted response expires at %v, want %v", got, expires)
+	}
+}
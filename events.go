@@ -0,0 +1,75 @@
+package httpcache
+
+import (
+	"fmt"
+	"log"
+)
+
+// EventKind identifies what happened to a stored response while a request was handled.
+type EventKind int
+
+const (
+	// EventNotModified means a stale response was revalidated with 304 Not Modified,
+	// freshened and served.
+	EventNotModified EventKind = iota
+	// EventReplaced means revalidation returned a full response (for example a 200
+	// with new validators, a 404 or a redirect) which replaced the stored response.
+	EventReplaced
+	// EventInvalidated means revalidation returned a full response that can't be
+	// stored, so the stored response was removed.
+	EventInvalidated
+	// EventStaleIfError means revalidation failed and the stale response was served
+	// under stale-if-error.
+	EventStaleIfError
+	// EventRevalidationFailed means revalidation failed with a transport error or a
+	// 5xx response. The failure, or a 504 if the stored response requires
+	// revalidation, was returned and the stored response was kept.
+	EventRevalidationFailed
+	// EventCorrupt means the stored response was damaged: it failed a checksum or
+	// couldn't be parsed. It was removed and the request handled as if nothing was
+	// stored.
+	EventCorrupt
+)
+
+var eventKindNames = []string{
+	EventNotModified:        "not-modified",
+	EventReplaced:           "replaced",
+	EventInvalidated:        "invalidated",
+	EventStaleIfError:       "stale-if-error",
+	EventRevalidationFailed: "revalidation-failed",
+	EventCorrupt:            "corrupt",
+}
+
+func (k EventKind) String() string {
+	if k >= 0 && int(k) < len(eventKindNames) {
+		return eventKindNames[k]
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// An Event is passed to Transport.Observer to describe how a request was handled.
+type Event struct {
+	Kind EventKind
+	// Key is the cache key of the request
+	Key string
+	// Err is the transport error behind the event, if any, or for EventCorrupt the
+	// damage that was found
+	Err error
+}
+
+// corrupt reports that the response stored under key was damaged, to t.Observer if
+// set and to the log otherwise, since the damage would go unnoticed.
+func (t *Transport) corrupt(key string, err error) {
+	if t.Observer == nil {
+		log.Printf("httpcache: removed corrupt response for %s: %v", key, err)
+		return
+	}
+	t.observe(EventCorrupt, key, err)
+}
+
+// observe reports an event to t.Observer, if set.
+func (t *Transport) observe(kind EventKind, key string, err error) {
+	if t.Observer != nil {
+		t.Observer(Event{Kind: kind, Key: key, Err: err})
+	}
+}
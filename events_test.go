@@ -0,0 +1,238 @@
+package httpcache
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestRevalidationOutcomes(t *testing.T) {
+	errOrigin := errors.New("connection refused")
+	tests := []struct {
+		name         string
+		cached       []string
+		revalidate   func() (*http.Response, error)
+		wantEvent    EventKind
+		wantStatus   int
+		wantErr      error
+		wantStored   bool
+		wantStoredIn string
+	}{
+		{
+			name: "not modified",
+			revalidate: func() (*http.Response, error) {
+				return newResponse(http.StatusNotModified, "", "Etag", `"a"`), nil
+			},
+			wantEvent:    EventNotModified,
+			wantStatus:   http.StatusOK,
+			wantStored:   true,
+			wantStoredIn: "old data",
+		},
+		{
+			name: "new validators",
+			revalidate: func() (*http.Response, error) {
+				return newResponse(http.StatusOK, "new data", "Etag", `"b"`), nil
+			},
+			wantEvent:    EventReplaced,
+			wantStatus:   http.StatusOK,
+			wantStored:   true,
+			wantStoredIn: `"b"`,
+		},
+		{
+			name: "no-store",
+			revalidate: func() (*http.Response, error) {
+				return newResponse(http.StatusOK, "new data", "Cache-Control", "no-store"), nil
+			},
+			wantEvent:  EventInvalidated,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "not found",
+			revalidate: func() (*http.Response, error) {
+				return newResponse(http.StatusNotFound, "not found"), nil
+			},
+			wantEvent:    EventReplaced,
+			wantStatus:   http.StatusNotFound,
+			wantStored:   true,
+			wantStoredIn: "404",
+		},
+		{
+			name: "gone",
+			revalidate: func() (*http.Response, error) {
+				return newResponse(http.StatusGone, "gone", "Cache-Control", "no-store"), nil
+			},
+			wantEvent:  EventInvalidated,
+			wantStatus: http.StatusGone,
+		},
+		{
+			name: "redirect",
+			revalidate: func() (*http.Response, error) {
+				return newResponse(http.StatusMovedPermanently, "", "Location", "http://elsewhere.com/"), nil
+			},
+			wantEvent:    EventReplaced,
+			wantStatus:   http.StatusMovedPermanently,
+			wantStored:   true,
+			wantStoredIn: "http://elsewhere.com/",
+		},
+		{
+			name: "server error",
+			revalidate: func() (*http.Response, error) {
+				return newResponse(http.StatusInternalServerError, "oops"), nil
+			},
+			wantEvent:    EventRevalidationFailed,
+			wantStatus:   http.StatusInternalServerError,
+			wantStored:   true,
+			wantStoredIn: "old data",
+		},
+		{
+			name: "transport error",
+			revalidate: func() (*http.Response, error) {
+				return nil, errOrigin
+			},
+			wantEvent:    EventRevalidationFailed,
+			wantErr:      errOrigin,
+			wantStored:   true,
+			wantStoredIn: "old data",
+		},
+		{
+			name:   "server error with stale-if-error",
+			cached: []string{"Cache-Control", "stale-if-error"},
+			revalidate: func() (*http.Response, error) {
+				return newResponse(http.StatusServiceUnavailable, "oops"), nil
+			},
+			wantEvent:    EventStaleIfError,
+			wantStatus:   http.StatusOK,
+			wantStored:   true,
+			wantStoredIn: "old data",
+		},
+	}
+	for _, test := range tests {
+		resetTest()
+		var events []Event
+		first := true
+		tp := NewMemoryCacheTransport()
+		tp.Observer = func(e Event) { events = append(events, e) }
+		tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if first {
+				first = false
+				return newResponse(http.StatusOK, "old data", append([]string{"Etag", `"a"`}, test.cached...)...), nil
+			}
+			return test.revalidate()
+		})
+
+		r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+		if _, err := tp.RoundTrip(r); err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 0 {
+			t.Fatalf("%s: unexpected events storing the response: %v", test.name, events)
+		}
+
+		resp, err := tp.RoundTrip(r)
+		if err != test.wantErr {
+			t.Fatalf("%s: got err %v, want %v", test.name, err, test.wantErr)
+		}
+		if err == nil && resp.StatusCode != test.wantStatus {
+			t.Errorf("%s: got status %d, want %d", test.name, resp.StatusCode, test.wantStatus)
+		}
+		if len(events) != 1 {
+			t.Fatalf("%s: got events %v, want one %v", test.name, events, test.wantEvent)
+		}
+		if events[0].Kind != test.wantEvent || events[0].Key != "http://somewhere.com/" || events[0].Err != test.wantErr {
+			t.Errorf("%s: got event %+v, want %v", test.name, events[0], test.wantEvent)
+		}
+		stored, ok := tp.Cache.Get("http://somewhere.com/")
+		if ok != test.wantStored {
+			t.Errorf("%s: stored is %v, want %v", test.name, ok, test.wantStored)
+		}
+		if ok && !bytes.Contains(stored, []byte(test.wantStoredIn)) {
+			t.Errorf("%s: stored response doesn't contain %q:\n%s", test.name, test.wantStoredIn, stored)
+		}
+	}
+}
+
+func TestHeadRevalidation(t *testing.T) {
+	resetTest()
+	var events []Event
+	var requests []*http.Request
+	tp := NewMemoryCacheTransport()
+	tp.Observer = func(e Event) { events = append(events, e) }
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req)
+		if req.Header.Get("If-None-Match") == `"a"` {
+			return newResponse(http.StatusNotModified, "", "Etag", `"a"`, "X-Revalidated", req.Method), nil
+		}
+		return newResponse(http.StatusOK, "some data", "Etag", `"a"`), nil
+	})
+
+	// A 304 to a HEAD request freshens the response stored for GET, rather than
+	// replacing it
+	for i, method := range []string{"GET", "HEAD", "GET"} {
+		r, _ := http.NewRequest(method, "http://somewhere.com/", nil)
+		resp, err := tp.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if stored, _ := tp.Cache.Get("http://somewhere.com/"); i == 1 && !bytes.Contains(stored, []byte("X-Revalidated: HEAD")) {
+			t.Fatalf("HEAD didn't freshen the stored response:\n%s", stored)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d, %s: got status %d, want 200", i, method, resp.StatusCode)
+		}
+		if method == "GET" && string(body) != "some data" {
+			t.Fatalf("request %d: got body %q", i, body)
+		}
+	}
+	if len(requests) != 3 || requests[1].Method != "HEAD" || requests[1].Header.Get("If-None-Match") != `"a"` {
+		t.Fatalf("got %d requests, want a conditional HEAD among 3", len(requests))
+	}
+	if len(events) != 2 || events[0].Kind != EventNotModified || events[1].Kind != EventNotModified {
+		t.Fatalf("got events %v, want two %v", events, EventNotModified)
+	}
+	stored, _ := tp.Cache.Get("http://somewhere.com/")
+	if !bytes.HasPrefix(stored, []byte("HTTP/1.1 200")) || !bytes.Contains(stored, []byte("some data")) {
+		t.Fatalf("stored response isn't the 200:\n%s", stored)
+	}
+}
+
+func TestHeadReplacement(t *testing.T) {
+	resetTest()
+	var events []Event
+	tp := NewMemoryCacheTransport()
+	tp.Observer = func(e Event) { events = append(events, e) }
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "HEAD" {
+			return newResponse(http.StatusOK, "", "Etag", `"b"`), nil
+		}
+		return newResponse(http.StatusOK, "some data", "Etag", `"a"`), nil
+	})
+
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	if _, err := tp.RoundTrip(r); err != nil {
+		t.Fatal(err)
+	}
+	// A full response to a HEAD request outdates the stored response without
+	// replacing it with one that has no body
+	head, _ := http.NewRequest("HEAD", "http://somewhere.com/", nil)
+	if _, err := tp.RoundTrip(head); err != nil {
+		t.Fatal(err)
+	}
+	if stored, ok := tp.Cache.Get("http://somewhere.com/"); ok {
+		t.Fatalf("stored response wasn't removed:\n%s", stored)
+	}
+	if len(events) != 1 || events[0].Kind != EventInvalidated {
+		t.Fatalf("got events %v, want %v", events, EventInvalidated)
+	}
+}
+
+func TestEventKindString(t *testing.T) {
+	if got := EventStaleIfError.String(); got != "stale-if-error" {
+		t.Errorf("got %q, want %q", got, "stale-if-error")
+	}
+	if got := EventKind(-1).String(); got != "EventKind(-1)" {
+		t.Errorf("got %q, want %q", got, "EventKind(-1)")
+	}
+}
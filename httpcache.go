@@ -1,9 +1,9 @@
 // Package httpcache provides a http.RoundTripper implementation that works as a
 // mostly RFC-compliant cache for http responses.
 //
-// It is only suitable for use as a 'private' cache (i.e. for a web-browser or an API-client
-// and not for a shared proxy).
-//
+// By default it behaves as a 'private' cache (i.e. for a web-browser or an API-client).
+// Setting Transport.Shared makes it honour the restrictions placed on shared caches,
+// but it is still not a complete implementation of a shared proxy.
 package httpcache
 
 import (
@@ -12,6 +12,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
@@ -39,41 +40,135 @@ type Cache interface {
 	Delete(key string)
 }
 
+// An ExpiringCache is a Cache that can discard a response once it is dead: past its
+// freshness lifetime and any stale-if-error window, with no validators to revalidate it.
+// Transport stores responses with SetWithExpiry when its Cache implements the interface
+// and ExpireDead is set.
+type ExpiringCache interface {
+	Cache
+	// SetWithExpiry stores the []byte representation of a response against a key, like
+	// Set, and allows the cache to discard it from expires on. A zero expires means the
+	// response never expires.
+	SetWithExpiry(key string, responseBytes []byte, expires time.Time)
+}
+
+// An ExpiryGetter is an ExpiringCache that also returns the expiry time stored with a
+// response, so that the response can be copied to another cache without losing it.
+type ExpiryGetter interface {
+	ExpiringCache
+	// GetWithExpiry returns the []byte representation of a response and the time it
+	// expires, which is zero if it never does, or ok false if it isn't present.
+	GetWithExpiry(key string) (responseBytes []byte, expires time.Time, ok bool)
+}
+
+// setWithExpiry saves resp to c with key until expires if c is an ExpiringCache, and
+// otherwise indefinitely.
+func setWithExpiry(c Cache, key string, resp []byte, expires time.Time) {
+	if ec, ok := c.(ExpiringCache); ok {
+		ec.SetWithExpiry(key, resp, expires)
+	} else {
+		c.Set(key, resp)
+	}
+}
+
+// getWithExpiry returns the response stored in c with key and, if c is an ExpiryGetter,
+// the time it expires.
+func getWithExpiry(c Cache, key string) (resp []byte, expires time.Time, ok bool) {
+	if eg, isGetter := c.(ExpiryGetter); isGetter {
+		return eg.GetWithExpiry(key)
+	}
+	resp, ok = c.Get(key)
+	return resp, time.Time{}, ok
+}
+
+// ErrCorrupt is returned, possibly wrapped, for a stored response that is damaged.
+var ErrCorrupt = errors.New("httpcache: stored response is corrupt")
+
+// A CheckedCache is a Cache that can tell a damaged response from a missing one.
+// CachedResponse, and so Transport, uses GetChecked when its Cache implements it.
+type CheckedCache interface {
+	Cache
+	// GetChecked returns the []byte representation of a cached response and true if
+	// present, or an error wrapping ErrCorrupt if the stored response is damaged
+	GetChecked(key string) (responseBytes []byte, ok bool, err error)
+}
+
 // cacheKey returns the cache key for req.
 func cacheKey(req *http.Request) string {
 	return req.URL.String()
 }
 
 // CachedResponse returns the cached http.Response for req if present, and nil
-// otherwise.
+// otherwise. It returns an error wrapping ErrCorrupt if the stored response is
+// damaged.
 func CachedResponse(c Cache, req *http.Request) (resp *http.Response, err error) {
-	cachedVal, ok := c.Get(cacheKey(req))
+	var cachedVal []byte
+	var ok bool
+	if cc, checked := c.(CheckedCache); checked {
+		cachedVal, ok, err = cc.GetChecked(cacheKey(req))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cachedVal, ok = c.Get(cacheKey(req))
+	}
 	if !ok {
 		return
 	}
 
 	b := bytes.NewBuffer(cachedVal)
-	return http.ReadResponse(bufio.NewReader(b), req)
+	resp, err = http.ReadResponse(bufio.NewReader(b), req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return resp, nil
 }
 
 // MemoryCache is an implemtation of Cache that stores responses in an in-memory map.
+// It implements ExpiryGetter: expired responses are no longer returned, and are
+// removed by Sweep or by a janitor started with StartJanitor.
 type MemoryCache struct {
 	mu    sync.RWMutex
-	items map[string][]byte
+	items map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	resp    []byte
+	expires time.Time
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
 }
 
 // Get returns the []byte representation of the response and true if present, false if not
 func (c *MemoryCache) Get(key string) (resp []byte, ok bool) {
+	resp, _, ok = c.GetWithExpiry(key)
+	return resp, ok
+}
+
+// GetWithExpiry returns the []byte representation of the response, the time it
+// expires, and true if present, false if not
+func (c *MemoryCache) GetWithExpiry(key string) (resp []byte, expires time.Time, ok bool) {
 	c.mu.RLock()
-	resp, ok = c.items[key]
+	e, ok := c.items[key]
 	c.mu.RUnlock()
-	return resp, ok
+	if !ok || e.expired(time.Now()) {
+		return nil, time.Time{}, false
+	}
+	return e.resp, e.expires, true
 }
 
 // Set saves response resp to the cache with key
 func (c *MemoryCache) Set(key string, resp []byte) {
+	c.SetWithExpiry(key, resp, time.Time{})
+}
+
+// SetWithExpiry saves response resp to the cache with key until expires, or
+// indefinitely if expires is zero.
+func (c *MemoryCache) SetWithExpiry(key string, resp []byte, expires time.Time) {
 	c.mu.Lock()
-	c.items[key] = resp
+	c.items[key] = memoryEntry{resp: resp, expires: expires}
 	c.mu.Unlock()
 }
 
@@ -84,9 +179,62 @@ func (c *MemoryCache) Delete(key string) {
 	c.mu.Unlock()
 }
 
+// Sweep removes expired responses from the cache and returns how many were removed.
+// Expired responses are found under the read lock, so Sweep holds up writers only
+// while deleting.
+func (c *MemoryCache) Sweep() int {
+	now := time.Now()
+	var dead []string
+	c.mu.RLock()
+	for key, e := range c.items {
+		if e.expired(now) {
+			dead = append(dead, key)
+		}
+	}
+	c.mu.RUnlock()
+	if len(dead) == 0 {
+		return 0
+	}
+
+	removed := 0
+	c.mu.Lock()
+	for _, key := range dead {
+		// The response may have been replaced since it was found
+		if e, ok := c.items[key]; ok && e.expired(now) {
+			delete(c.items, key)
+			removed++
+		}
+	}
+	c.mu.Unlock()
+	return removed
+}
+
+// StartJanitor starts a goroutine that calls Sweep every interval, and returns a
+// function that stops it. Without a janitor, expired responses stay in memory until
+// they are replaced or deleted.
+func (c *MemoryCache) StartJanitor(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				c.Sweep()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
 // NewMemoryCache returns a new Cache that will store items in an in-memory map
 func NewMemoryCache() *MemoryCache {
-	c := &MemoryCache{items: map[string][]byte{}}
+	c := &MemoryCache{items: map[string]memoryEntry{}}
 	return c
 }
 
@@ -127,6 +275,32 @@ type Transport struct {
 	Cache     Cache
 	// If true, responses returned from the cache will be given an extra header, X-From-Cache
 	MarkCachedResponses bool
+	// If non-nil, Observer is called with an Event each time a stored response is
+	// revalidated, replaced or removed
+	Observer func(Event)
+	// If true, the Transport stores responses as a shared cache would: responses marked
+	// private, and responses to requests carrying Authorization, aren't stored unless the
+	// response explicitly allows it, and fields named in private="..." are left out
+	Shared bool
+	// If true, the immutable extension (RFC 8246) is ignored and requests with
+	// Cache-Control: no-cache always bypass the cache
+	IgnoreImmutable bool
+	// If non-zero, a transport error (such as a DNS failure or a refused connection)
+	// is remembered for NegativeTTL, and requests made meanwhile fail at once with a
+	// *RecentFailureError instead of reaching the underlying Transport. A stored
+	// response is still served under stale-if-error. HTTP error responses aren't
+	// affected
+	NegativeTTL time.Duration
+	// If true, transport errors are remembered per host rather than per cache key
+	NegativePerHost bool
+	// If true, responses stored in an ExpiringCache are discarded once they are dead,
+	// so that a janitor can reclaim the space. Requests with only-if-cached or max-stale
+	// may accept a stored response at any age, so by default responses are kept until
+	// they are replaced, removed or evicted
+	ExpireDead bool
+	// guards failures
+	failMu   sync.Mutex
+	failures map[string]failure
 	// guards modReq
 	mu sync.RWMutex
 	// Mapping of original request => cloned
@@ -145,9 +319,14 @@ func (t *Transport) Client() *http.Client {
 }
 
 // varyMatches will return false unless all of the cached values for the headers listed in Vary
-// match the new request
+// match the new request. HTTP/1.0 servers predate Vary and can't be relied on to list every
+// header they select on, so an HTTP/1.0 response carrying Vary never matches.
 func varyMatches(cachedResp *http.Response, req *http.Request) bool {
-	for _, header := range headerAllCommaSepValues(cachedResp.Header, "vary") {
+	vary := headerAllCommaSepValues(cachedResp.Header, "vary")
+	if len(vary) > 0 && !cachedResp.ProtoAtLeast(1, 1) {
+		return false
+	}
+	for _, header := range vary {
 		header = http.CanonicalHeaderKey(header)
 		if header != "" && req.Header.Get(header) != cachedResp.Header.Get("X-Varied-"+header) {
 			return false
@@ -177,13 +356,27 @@ func (t *Transport) setModReq(orig, mod *http.Request) {
 //
 // If there is a stale Response, then any validators it contains will be set on the new request
 // to give the server a chance to respond with NotModified. If this happens, then the cached Response
-// will be returned.
+// will be returned. Any other full response replaces the stored one, or removes it if it can't be
+// stored. A transport error or 5xx response leaves the stored Response in place; it's served if
+// stale-if-error allows and the failure is passed on otherwise. Each outcome is reported to Observer.
+//
+// A stored Response that is damaged is removed, reported to Observer (or logged if there is no
+// Observer), and the request is handled as if nothing was stored.
+//
+// If the caller sends its own If-None-Match or If-Modified-Since, a fresh Response is used to
+// answer it, with 304 / Not Modified if the conditions match, and stale Responses are validated
+// with the caller's conditions, passing any 304 back to the caller unchanged.
 func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 	cacheKey := cacheKey(req)
 	cacheable := (req.Method == "GET" || req.Method == "HEAD") && req.Header.Get("range") == ""
 	var cachedResp *http.Response
 	if cacheable {
 		cachedResp, err = CachedResponse(t.Cache, req)
+		if err != nil {
+			t.Cache.Delete(cacheKey)
+			t.corrupt(cacheKey, err)
+			cachedResp, err = nil, nil
+		}
 	} else {
 		// Need to invalidate an existing value
 		t.Cache.Delete(cacheKey)
@@ -193,29 +386,44 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 	if transport == nil {
 		transport = http.DefaultTransport
 	}
+	conditional := hasConditionals(req)
 
 	if cacheable && cachedResp != nil && err == nil {
 		if t.MarkCachedResponses {
 			cachedResp.Header.Set(XFromCache, "1")
 		}
 
-		if varyMatches(cachedResp, req) {
+		origReq := req
+		freshness := transparent
+		matched := varyMatches(cachedResp, req)
+		if matched {
 			// Can only use cached value if the new request doesn't Vary significantly
-			freshness := getFreshness(cachedResp.Header, req.Header)
+			if _, ok := effectiveCacheControl(req.Header)["no-cache"]; ok && t.IgnoreImmutable {
+				freshness = transparent
+			} else {
+				freshness = getFreshness(cachedResp.Header, req.Header)
+			}
 			if freshness == fresh {
+				if conditional && notModified(cachedResp, req) {
+					return newNotModifiedResponse(cachedResp, req), nil
+				}
 				return cachedResp, nil
 			}
 
 			if freshness == stale {
+				if _, ok := effectiveCacheControl(req.Header)["only-if-cached"]; ok {
+					// The cached response needs validating, which the caller has forbidden
+					return newGatewayTimeoutResponse(req), nil
+				}
 				var req2 *http.Request
 				// Add validators if caller hasn't already done so
 				etag := cachedResp.Header.Get("etag")
-				if etag != "" && req.Header.Get("etag") == "" {
+				if etag != "" && !conditional {
 					req2 = cloneRequest(req)
 					req2.Header.Set("if-none-match", etag)
 				}
 				lastModified := cachedResp.Header.Get("last-modified")
-				if lastModified != "" && req.Header.Get("last-modified") == "" {
+				if lastModified != "" && !conditional {
 					if req2 == nil {
 						req2 = cloneRequest(req)
 					}
@@ -243,63 +451,150 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 			}
 		}
 
-		resp, err = transport.RoundTrip(req)
-		if err == nil && req.Method == "GET" && resp.StatusCode == http.StatusNotModified {
-			// Replace the 304 response with the one from cache, but update with some new headers
-			endToEndHeaders := getEndToEndHeaders(resp.Header)
-			for _, header := range endToEndHeaders {
-				cachedResp.Header[header] = resp.Header[header]
+		resp, err = t.send(transport, req, cacheKey)
+		if err == nil {
+			ensureDate(resp)
+		}
+		if err == nil && req != origReq && resp.StatusCode == http.StatusNotModified &&
+			!selectsForUpdate(cachedResp, resp, true) {
+			// The 304 describes a different representation than the stored one, so it can't
+			// be used to complete the response. Fetch a full response instead
+			resp.Body.Close()
+			t.Cache.Delete(cacheKey)
+			resp, err = t.send(transport, origReq, cacheKey)
+			if err != nil {
+				t.observe(EventInvalidated, cacheKey, err)
+				return nil, err
 			}
-			cachedResp.Status = fmt.Sprintf("%d %s", http.StatusOK, http.StatusText(http.StatusOK))
-			cachedResp.StatusCode = http.StatusOK
-
+			ensureDate(resp)
+		}
+		if err == nil && conditional && resp.StatusCode == http.StatusNotModified {
+			// The caller asked for this 304 with its own validators, so it's passed on as is,
+			// but it may still freshen the stored response
+			if matched && selectsForUpdate(cachedResp, resp, false) {
+				t.freshenStored(cacheKey, req, cachedResp, resp)
+			}
+			return resp, nil
+		} else if err == nil && (req.Method == "GET" || req.Method == "HEAD") && resp.StatusCode == http.StatusNotModified {
+			// Replace the 304 response with the one from cache, updated with the new headers.
+			// A HEAD request revalidates the stored response of a GET the same way
+			t.observe(EventNotModified, cacheKey, nil)
+			if req.Method == "HEAD" {
+				t.freshenStored(cacheKey, origReq, cachedResp, resp)
+				return cachedResp, nil
+			}
+			freshen(cachedResp, resp)
 			resp = cachedResp
-		} else if (err != nil || (cachedResp != nil && resp.StatusCode >= 500)) &&
+		} else if (err != nil || resp.StatusCode >= 500) &&
 			req.Method == "GET" && canStaleOnError(cachedResp.Header, req.Header) {
 			// In case of transport failure and stale-if-error activated, returns cached content
 			// when available
 			cachedResp.Status = fmt.Sprintf("%d %s", http.StatusOK, http.StatusText(http.StatusOK))
 			cachedResp.StatusCode = http.StatusOK
+			t.observe(EventStaleIfError, cacheKey, err)
 			return cachedResp, nil
-		} else {
-			if err != nil || resp.StatusCode != http.StatusOK {
-				t.Cache.Delete(cacheKey)
+		} else if err != nil && freshness == stale && mustRevalidate(effectiveCacheControl(cachedResp.Header)) {
+			// The stale response can't be served without revalidation, so report that
+			// the origin couldn't be reached rather than failing the request outright
+			t.observe(EventRevalidationFailed, cacheKey, err)
+			return newGatewayTimeoutResponse(req), nil
+		} else if err != nil || resp.StatusCode >= 500 {
+			// The origin failed rather than answering for the resource, so the stored
+			// response is kept for later revalidation and the failure is passed on
+			if freshness == stale {
+				t.observe(EventRevalidationFailed, cacheKey, err)
 			}
 			if err != nil {
 				return nil, err
 			}
+			return resp, nil
+		} else if freshness == stale {
+			if req.Method == "HEAD" {
+				// A response without a body can't replace the stored response of a GET,
+				// which it shows to be outdated
+				t.Cache.Delete(cacheKey)
+				t.observe(EventInvalidated, cacheKey, nil)
+				return resp, nil
+			}
+			// Any other full response (a 200 with new validators, 404, 410, a redirect)
+			// supersedes the stored response
+			if t.store(cacheKey, req, resp) {
+				t.observe(EventReplaced, cacheKey, nil)
+			} else {
+				t.observe(EventInvalidated, cacheKey, nil)
+			}
+			return resp, nil
 		}
 	} else {
-		reqCacheControl := parseCacheControl(req.Header)
+		reqCacheControl := effectiveCacheControl(req.Header)
 		if _, ok := reqCacheControl["only-if-cached"]; ok {
 			resp = newGatewayTimeoutResponse(req)
 		} else {
-			resp, err = transport.RoundTrip(req)
+			resp, err = t.send(transport, req, cacheKey)
 			if err != nil {
 				return nil, err
 			}
+			ensureDate(resp)
 		}
 	}
 
-	if cacheable && canStore(parseCacheControl(req.Header), parseCacheControl(resp.Header)) {
-		for _, varyKey := range headerAllCommaSepValues(resp.Header, "vary") {
-			varyKey = http.CanonicalHeaderKey(varyKey)
-			fakeHeader := "X-Varied-" + varyKey
-			reqValue := req.Header.Get(varyKey)
-			if reqValue != "" {
-				resp.Header.Set(fakeHeader, reqValue)
-			}
-		}
-		respBytes, err := httputil.DumpResponse(resp, true)
-		if err == nil {
-			t.Cache.Set(cacheKey, respBytes)
-		}
+	if cacheable && resp.StatusCode != http.StatusNotModified {
+		t.store(cacheKey, req, resp)
 	} else {
 		t.Cache.Delete(cacheKey)
 	}
 	return resp, nil
 }
 
+// freshenStored updates cachedResp, the stored response to req, with the headers of
+// the 304 response resp, and stores it again. For a HEAD request cachedResp was read
+// without its body, which storing it would lose, so the stored response of a GET is
+// read and freshened on its own.
+func (t *Transport) freshenStored(key string, req *http.Request, cachedResp, resp *http.Response) {
+	freshen(cachedResp, resp)
+	if req.Method != "HEAD" {
+		t.store(key, req, cachedResp)
+		return
+	}
+	getReq := cloneRequest(req)
+	getReq.Method = "GET"
+	if stored, err := CachedResponse(t.Cache, getReq); err == nil && stored != nil {
+		freshen(stored, resp)
+		t.store(key, req, stored)
+	}
+}
+
+// store saves resp as the response to req under key if both allow it, and otherwise
+// removes whatever is stored under key. It reports whether resp was stored.
+func (t *Transport) store(key string, req *http.Request, resp *http.Response) bool {
+	respCacheControl := effectiveCacheControl(resp.Header)
+	if !canStore(effectiveCacheControl(req.Header), respCacheControl) ||
+		(t.Shared && !sharedCanStore(req, respCacheControl)) {
+		t.Cache.Delete(key)
+		return false
+	}
+	for _, varyKey := range headerAllCommaSepValues(resp.Header, "vary") {
+		varyKey = http.CanonicalHeaderKey(varyKey)
+		fakeHeader := "X-Varied-" + varyKey
+		reqValue := req.Header.Get(varyKey)
+		if reqValue != "" {
+			resp.Header.Set(fakeHeader, reqValue)
+		}
+	}
+	omit := append(omittedHeaders(respCacheControl, t.Shared), getHopByHopHeaders(resp.Header)...)
+	respBytes, err := dumpResponse(resp, omit)
+	if err != nil {
+		t.Cache.Delete(key)
+		return false
+	}
+	if t.ExpireDead {
+		setWithExpiry(t.Cache, key, respBytes, expiry(resp.Header, req.Header))
+	} else {
+		t.Cache.Set(key, respBytes)
+	}
+	return true
+}
+
 // CancelRequest calls CancelRequest on the underlaying transport if implemented or
 // throw a warning otherwise.
 func (t *Transport) CancelRequest(req *http.Request) {
@@ -328,7 +623,8 @@ func (t *Transport) CancelRequest(req *http.Request) {
 // ErrNoDateHeader indicates that the HTTP headers contained no Date header.
 var ErrNoDateHeader = errors.New("no Date header")
 
-// Date parses and returns the value of the Date header.
+// Date parses and returns the value of the Date header. All three HTTP-date formats
+// are accepted, see ParseHTTPDate.
 func Date(respHeaders http.Header) (date time.Time, err error) {
 	dateHeader := respHeaders.Get("date")
 	if dateHeader == "" {
@@ -336,7 +632,36 @@ func Date(respHeaders http.Header) (date time.Time, err error) {
 		return
 	}
 
-	return time.Parse(time.RFC1123, dateHeader)
+	return ParseHTTPDate(dateHeader)
+}
+
+// ParseHTTPDate parses an HTTP-date in any of the formats recipients must accept
+// (RFC 9110, section 5.6.7): IMF-fixdate, RFC 850 and asctime. Like http.ParseTime
+// it also tolerates RFC 1123 dates that use a zone other than GMT.
+func ParseHTTPDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	t, err := http.ParseTime(value)
+	if err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{time.RFC1123, time.RFC1123Z} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return t, err
+}
+
+// ensureDate adds a Date header set to the time of receipt if resp doesn't carry a
+// valid one, as RFC 9110 requires of recipients with a clock. Without it the
+// response could never be considered fresh.
+func ensureDate(resp *http.Response) {
+	if _, err := Date(resp.Header); err != nil {
+		if resp.Header == nil {
+			resp.Header = make(http.Header)
+		}
+		resp.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
 }
 
 type realClock struct{}
@@ -358,18 +683,30 @@ var clock timer = &realClock{}
 // stale indicates that the response needs validating before it is returned
 // transparent indicates the response should not be used to fulfil the request
 //
-// Because this is only a private cache, 'public' and 'private' in cache-control aren't
-// signficant. Similarly, smax-age isn't used.
+// 'public' and 'private' in cache-control only affect whether a response is stored, so they
+// aren't significant here. Similarly, smax-age isn't used. A no-cache directive that lists
+// field names doesn't force revalidation, because those fields are never stored.
+//
+// A request with no-cache normally gets transparent, but a fresh response marked immutable
+// (RFC 8246) is still returned, since such requests are usually reloads and the response
+// is guaranteed not to change while fresh.
 func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
-	respCacheControl := parseCacheControl(respHeaders)
-	reqCacheControl := parseCacheControl(reqHeaders)
+	respCacheControl := effectiveCacheControl(respHeaders)
+	reqCacheControl := effectiveCacheControl(reqHeaders)
 	if _, ok := reqCacheControl["no-cache"]; ok {
-		return transparent
+		if _, ok := respCacheControl["immutable"]; !ok {
+			return transparent
+		}
+		defer func() {
+			if freshness != fresh {
+				freshness = transparent
+			}
+		}()
 	}
-	if _, ok := respCacheControl["no-cache"]; ok {
+	if noCache, ok := respCacheControl["no-cache"]; ok && noCache == "" {
 		return stale
 	}
-	if _, ok := reqCacheControl["only-if-cached"]; ok {
+	if _, ok := reqCacheControl["only-if-cached"]; ok && !mustRevalidate(respCacheControl) {
 		return fresh
 	}
 
@@ -385,15 +722,13 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 	// If a response includes both an Expires header and a max-age directive,
 	// the max-age directive overrides the Expires header, even if the Expires header is more restrictive.
 	if maxAge, ok := respCacheControl["max-age"]; ok {
-		lifetime, err = time.ParseDuration(maxAge + "s")
-		if err != nil {
-			lifetime = zeroDuration
-		}
+		// An invalid max-age leaves a zero lifetime, making the response stale
+		lifetime, _ = parseDeltaSeconds(maxAge)
 	} else {
-		expiresHeader := respHeaders.Get("Expires")
-		if expiresHeader != "" {
-			expires, err := time.Parse(time.RFC1123, expiresHeader)
+		if expiresHeader, ok := respHeaders["Expires"]; ok {
+			expires, err := ParseHTTPDate(expiresHeader[0])
 			if err != nil {
+				// Invalid dates, such as "0", represent a time in the past
 				lifetime = zeroDuration
 			} else {
 				lifetime = expires.Sub(date)
@@ -403,24 +738,22 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 
 	if maxAge, ok := reqCacheControl["max-age"]; ok {
 		// the client is willing to accept a response whose age is no greater than the specified time in seconds
-		lifetime, err = time.ParseDuration(maxAge + "s")
-		if err != nil {
-			lifetime = zeroDuration
-		}
+		lifetime, _ = parseDeltaSeconds(maxAge)
 	}
 	if minfresh, ok := reqCacheControl["min-fresh"]; ok {
 		//  the client wants a response that will still be fresh for at least the specified number of seconds.
-		minfreshDuration, err := time.ParseDuration(minfresh + "s")
-		if err == nil {
+		minfreshDuration, ok := parseDeltaSeconds(minfresh)
+		if ok {
 			currentAge = time.Duration(currentAge + minfreshDuration)
 		}
 	}
 
-	if maxstale, ok := reqCacheControl["max-stale"]; ok {
+	if maxstale, ok := reqCacheControl["max-stale"]; ok && !mustRevalidate(respCacheControl) {
 		// Indicates that the client is willing to accept a response that has exceeded its expiration time.
 		// If max-stale is assigned a value, then the client is willing to accept a response that has exceeded
 		// its expiration time by no more than the specified number of seconds.
 		// If no value is assigned to max-stale, then the client is willing to accept a stale response of any age.
+		// Neither applies when the response requires revalidation once stale.
 		//
 		// Responses served only because of a max-stale value are supposed to have a Warning header added to them,
 		// but that seems like a  hassle, and is it actually useful? If so, then there needs to be a different
@@ -428,8 +761,8 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 		if maxstale == "" {
 			return fresh
 		}
-		maxstaleDuration, err := time.ParseDuration(maxstale + "s")
-		if err == nil {
+		maxstaleDuration, ok := parseDeltaSeconds(maxstale)
+		if ok {
 			currentAge = time.Duration(currentAge - maxstaleDuration)
 		}
 	}
@@ -441,19 +774,67 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 	return stale
 }
 
+// expiry returns the time from which a stored response with respHeaders is dead, or the
+// zero time if it may stay useful indefinitely. A response with a validator can always
+// be revalidated, so it never expires. Otherwise it expires once it is past both its
+// freshness lifetime and the longest stale-if-error window given by the response or by
+// the request it answers, reqHeaders. Later requests with only-if-cached, max-stale or a
+// longer stale-if-error could still accept it after that, which is why Transport only
+// passes the expiry on when ExpireDead is set.
+func expiry(respHeaders, reqHeaders http.Header) time.Time {
+	if respHeaders.Get("Etag") != "" || respHeaders.Get("Last-Modified") != "" {
+		return time.Time{}
+	}
+	date, err := Date(respHeaders)
+	if err != nil {
+		return time.Time{}
+	}
+	respCacheControl := effectiveCacheControl(respHeaders)
+
+	var lifetime time.Duration
+	if noCache, ok := respCacheControl["no-cache"]; ok && noCache == "" {
+		// Never fresh
+	} else if maxAge, ok := respCacheControl["max-age"]; ok {
+		lifetime, _ = parseDeltaSeconds(maxAge)
+	} else if expiresHeader, ok := respHeaders["Expires"]; ok {
+		if expires, err := ParseHTTPDate(expiresHeader[0]); err == nil {
+			lifetime = expires.Sub(date)
+		}
+	}
+	if !mustRevalidate(respCacheControl) {
+		var window time.Duration
+		for _, cc := range []CacheControl{respCacheControl, effectiveCacheControl(reqHeaders)} {
+			staleIfError, ok := cc["stale-if-error"]
+			if !ok {
+				continue
+			}
+			if staleIfError == "" {
+				return time.Time{}
+			}
+			if d, ok := parseDeltaSeconds(staleIfError); ok && d > window {
+				window = d
+			}
+		}
+		lifetime += window
+	}
+	return time.Now().Add(lifetime - clock.since(date))
+}
+
 // Returns true if either the request or the response includes the stale-if-error
-// cache control extension: https://tools.ietf.org/html/rfc5861
+// cache control extension: https://tools.ietf.org/html/rfc5861, unless the response
+// requires revalidation once stale
 func canStaleOnError(respHeaders, reqHeaders http.Header) bool {
-	respCacheControl := parseCacheControl(respHeaders)
-	reqCacheControl := parseCacheControl(reqHeaders)
+	respCacheControl := effectiveCacheControl(respHeaders)
+	reqCacheControl := effectiveCacheControl(reqHeaders)
+	if mustRevalidate(respCacheControl) {
+		return false
+	}
 
-	var err error
 	lifetime := time.Duration(-1)
 
 	if staleMaxAge, ok := respCacheControl["stale-if-error"]; ok {
 		if staleMaxAge != "" {
-			lifetime, err = time.ParseDuration(staleMaxAge + "s")
-			if err != nil {
+			if lifetime, ok = parseDeltaSeconds(staleMaxAge); !ok {
 				return false
 			}
 		} else {
@@ -462,8 +843,7 @@ func canStaleOnError(respHeaders, reqHeaders http.Header) bool {
 	}
 	if staleMaxAge, ok := reqCacheControl["stale-if-error"]; ok {
 		if staleMaxAge != "" {
-			lifetime, err = time.ParseDuration(staleMaxAge + "s")
-			if err != nil {
+			if lifetime, ok = parseDeltaSeconds(staleMaxAge); !ok {
 				return false
 			}
 		} else {
@@ -485,6 +865,52 @@ func canStaleOnError(respHeaders, reqHeaders http.Header) bool {
 	return false
 }
 
+// mustRevalidate reports whether the response forbids serving it once it is stale.
+// proxy-revalidate is treated the same way; it only binds shared caches, but a
+// private cache is always free to revalidate instead of serving stale content.
+func mustRevalidate(respCacheControl CacheControl) bool {
+	if _, ok := respCacheControl["must-revalidate"]; ok {
+		return true
+	}
+	_, ok := respCacheControl["proxy-revalidate"]
+	return ok
+}
+
+// selectsForUpdate reports whether a 304 Not Modified response identifies cachedResp
+// as the stored response to freshen (RFC 9111, section 4.3.4). A strong ETag must
+// match exactly, while a weak ETag or Last-Modified must match cachedResp's. A 304
+// without validators only selects cachedResp if it answers a request that carried
+// validators taken from cachedResp itself, which ownValidators indicates.
+func selectsForUpdate(cachedResp, notModified *http.Response, ownValidators bool) bool {
+	if etag := notModified.Header.Get("ETag"); etag != "" {
+		cachedETag := cachedResp.Header.Get("ETag")
+		if !strings.HasPrefix(etag, "W/") {
+			return etag == cachedETag
+		}
+		return cachedETag != "" && weakETagMatch(etag, cachedETag)
+	}
+	if lm := notModified.Header.Get("Last-Modified"); lm != "" {
+		lastModified, err := ParseHTTPDate(lm)
+		if err != nil {
+			return false
+		}
+		cachedLastModified, err := ParseHTTPDate(cachedResp.Header.Get("Last-Modified"))
+		return err == nil && lastModified.Equal(cachedLastModified)
+	}
+	return ownValidators
+}
+
+// freshen updates cachedResp with the header fields of a 304 Not Modified response
+// that selected it. Content-Length and hop-by-hop fields aren't updated; the status
+// and body of cachedResp are kept.
+func freshen(cachedResp, notModified *http.Response) {
+	for _, header := range getEndToEndHeaders(notModified.Header) {
+		if header != "Content-Length" {
+			cachedResp.Header[header] = notModified.Header[header]
+		}
+	}
+}
+
 func getEndToEndHeaders(respHeaders http.Header) []string {
 	// These headers are always hop-by-hop
 	hopByHopHeaders := map[string]struct{}{
@@ -492,10 +918,10 @@ func getEndToEndHeaders(respHeaders http.Header) []string {
 		"Keep-Alive":          struct{}{},
 		"Proxy-Authenticate":  struct{}{},
 		"Proxy-Authorization": struct{}{},
-		"Te":                struct{}{},
-		"Trailers":          struct{}{},
-		"Transfer-Encoding": struct{}{},
-		"Upgrade":           struct{}{},
+		"Te":                  struct{}{},
+		"Trailers":            struct{}{},
+		"Transfer-Encoding":   struct{}{},
+		"Upgrade":             struct{}{},
 	}
 
 	for _, extra := range strings.Split(respHeaders.Get("connection"), ",") {
@@ -513,7 +939,23 @@ func getEndToEndHeaders(respHeaders http.Header) []string {
 	return endToEndHeaders
 }
 
-func canStore(reqCacheControl, respCacheControl cacheControl) (canStore bool) {
+// getHopByHopHeaders returns the header fields of respHeaders that apply only to a
+// single connection, such as Connection and Keep-Alive, and so mustn't be stored.
+func getHopByHopHeaders(respHeaders http.Header) []string {
+	endToEnd := map[string]struct{}{}
+	for _, header := range getEndToEndHeaders(respHeaders) {
+		endToEnd[header] = struct{}{}
+	}
+	var hopByHop []string
+	for header := range respHeaders {
+		if _, ok := endToEnd[header]; !ok {
+			hopByHop = append(hopByHop, header)
+		}
+	}
+	return hopByHop
+}
+
+func canStore(reqCacheControl, respCacheControl CacheControl) (canStore bool) {
 	if _, ok := respCacheControl["no-store"]; ok {
 		return false
 	}
@@ -523,6 +965,136 @@ func canStore(reqCacheControl, respCacheControl cacheControl) (canStore bool) {
 	return true
 }
 
+// sharedCanStore reports whether a shared cache may store the response to req.
+// Responses marked private can't be stored, and neither can responses to
+// requests with Authorization unless the response explicitly allows it.
+func sharedCanStore(req *http.Request, respCacheControl CacheControl) bool {
+	if private, ok := respCacheControl["private"]; ok && private == "" {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" {
+		for _, directive := range []string{"public", "s-maxage", "must-revalidate"} {
+			if _, ok := respCacheControl[directive]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// omittedHeaders returns the header fields that must be removed from a response
+// before it is stored: X-From-Cache, those named by a qualified no-cache directive
+// and, for a shared cache, those named by a qualified private directive.
+func omittedHeaders(respCacheControl CacheControl, shared bool) []string {
+	omit := append([]string{XFromCache}, respCacheControl.FieldNames("no-cache")...)
+	if shared {
+		omit = append(omit, respCacheControl.FieldNames("private")...)
+	}
+	return omit
+}
+
+// dumpResponse returns the wire representation of resp without the headers in
+// omit. The headers of resp itself are left untouched.
+func dumpResponse(resp *http.Response, omit []string) ([]byte, error) {
+	if len(omit) == 0 {
+		return httputil.DumpResponse(resp, true)
+	}
+	header := resp.Header
+	resp.Header = make(http.Header, len(header))
+	for k, v := range header {
+		resp.Header[k] = v
+	}
+	for _, k := range omit {
+		resp.Header.Del(k)
+	}
+	respBytes, err := httputil.DumpResponse(resp, true)
+	resp.Header = header
+	return respBytes, err
+}
+
+// hasConditionals reports whether the caller has made req conditional with validators
+// of its own.
+func hasConditionals(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+// notModified evaluates the conditional headers of req against cachedResp as an origin
+// server would (RFC 9110, section 13.2.2). If-None-Match uses the weak comparison
+// function and, when present, takes precedence over If-Modified-Since.
+func notModified(cachedResp *http.Response, req *http.Request) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := cachedResp.Header.Get("ETag")
+		for _, tag := range splitETags(inm) {
+			if tag == "*" || (etag != "" && weakETagMatch(tag, etag)) {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := ParseHTTPDate(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := ParseHTTPDate(cachedResp.Header.Get("Last-Modified"))
+	if err != nil {
+		// Without Last-Modified, the response is known to be unchanged since its Date
+		if lastModified, err = Date(cachedResp.Header); err != nil {
+			return false
+		}
+	}
+	return !lastModified.After(ims)
+}
+
+// splitETags splits an If-None-Match list into its entity tags. Commas are valid
+// inside an opaque-tag, so only those outside quotes separate entries.
+func splitETags(list string) []string {
+	var tags []string
+	quoted := false
+	start := 0
+	for i := 0; i <= len(list); i++ {
+		if i < len(list) && list[i] == '"' {
+			quoted = !quoted
+		}
+		if i == len(list) || (list[i] == ',' && !quoted) {
+			if tag := strings.TrimSpace(list[start:i]); tag != "" {
+				tags = append(tags, tag)
+			}
+			start = i + 1
+		}
+	}
+	return tags
+}
+
+// weakETagMatch reports whether two entity tags are equal when their weakness
+// indicators are ignored.
+func weakETagMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// newNotModifiedResponse builds the 304 Not Modified response that the origin would
+// have sent for cachedResp. It carries the fields RFC 9110 requires of a 304, and
+// the X-From-Cache marker if cachedResp has one.
+func newNotModifiedResponse(cachedResp *http.Response, req *http.Request) *http.Response {
+	header := make(http.Header)
+	for _, k := range []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Vary", XFromCache} {
+		k = http.CanonicalHeaderKey(k)
+		if v, ok := cachedResp.Header[k]; ok {
+			header[k] = v
+		}
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", http.StatusNotModified, http.StatusText(http.StatusNotModified)),
+		StatusCode: http.StatusNotModified,
+		Proto:      cachedResp.Proto,
+		ProtoMajor: cachedResp.ProtoMajor,
+		ProtoMinor: cachedResp.ProtoMinor,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		Request:    req,
+	}
+}
+
 func newGatewayTimeoutResponse(req *http.Request) *http.Response {
 	var braw bytes.Buffer
 	braw.WriteString("HTTP/1.1 504 Gateway Timeout\r\n\r\n")
@@ -548,26 +1120,6 @@ func cloneRequest(r *http.Request) *http.Request {
 	return r2
 }
 
-type cacheControl map[string]string
-
-func parseCacheControl(headers http.Header) cacheControl {
-	cc := cacheControl{}
-	ccHeader := headers.Get("Cache-Control")
-	for _, part := range strings.Split(ccHeader, ",") {
-		part = strings.Trim(part, " ")
-		if part == "" {
-			continue
-		}
-		if strings.ContainsRune(part, '=') {
-			keyval := strings.Split(part, "=")
-			cc[strings.Trim(keyval[0], " ")] = strings.Trim(keyval[1], ",")
-		} else {
-			cc[part] = ""
-		}
-	}
-	return cc
-}
-
 // headerAllCommaSepValues returns all comma-separated values (each
 // with whitespace trimmed) for header name in headers. According to
 // Section 4.2 of the HTTP/1.1 spec
@@ -744,13 +744,13 @@ func TestUpdateFields(t *testing.T) {
 func TestParseCacheControl(t *testing.T) {
 	resetTest()
 	h := http.Header{}
-	for range parseCacheControl(h) {
+	for range ParseCacheControl(h) {
 		t.Fatal("cacheControl should be empty")
 	}
 
 	h.Set("cache-control", "no-cache")
 	{
-		cc := parseCacheControl(h)
+		cc := ParseCacheControl(h)
 		if _, ok := cc["foo"]; ok {
 			t.Error(`Value "foo" shouldn't exist`)
 		}
@@ -764,7 +764,7 @@ func TestParseCacheControl(t *testing.T) {
 	}
 	h.Set("cache-control", "no-cache, max-age=3600")
 	{
-		cc := parseCacheControl(h)
+		cc := ParseCacheControl(h)
 		noCache, ok := cc["no-cache"]
 		if !ok {
 			t.Fatalf(`"no-cache" value isn't set`)
@@ -790,6 +790,63 @@ func TestNoCacheRequestExpiration(t *testing.T) {
 	}
 }
 
+func TestNoCacheRequestImmutable(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	respHeaders := http.Header{}
+	respHeaders.Set("Date", now.Format(time.RFC1123))
+	respHeaders.Set("Cache-Control", "max-age=10, immutable")
+
+	reqHeaders := http.Header{}
+	reqHeaders.Set("Cache-Control", "no-cache")
+	if getFreshness(respHeaders, reqHeaders) != fresh {
+		t.Fatal("freshness isn't fresh")
+	}
+
+	clock = &fakeClock{elapsed: 20 * time.Second}
+	if getFreshness(respHeaders, reqHeaders) != transparent {
+		t.Fatal("freshness isn't transparent")
+	}
+
+	clock = &realClock{}
+	respHeaders.Set("Cache-Control", "max-age=10, immutable, no-cache")
+	if getFreshness(respHeaders, reqHeaders) != transparent {
+		t.Fatal("freshness isn't transparent")
+	}
+}
+
+func TestPragmaNoCacheRequest(t *testing.T) {
+	resetTest()
+	respHeaders := http.Header{}
+	respHeaders.Set("Date", time.Now().Format(time.RFC1123))
+	respHeaders.Set("Cache-Control", "max-age=7200")
+
+	reqHeaders := http.Header{}
+	reqHeaders.Set("Pragma", "no-cache")
+	if getFreshness(respHeaders, reqHeaders) != transparent {
+		t.Fatal("freshness isn't transparent")
+	}
+
+	// Cache-Control takes precedence over Pragma when both are present
+	reqHeaders.Set("Cache-Control", "max-stale")
+	if getFreshness(respHeaders, reqHeaders) != fresh {
+		t.Fatal("freshness isn't fresh")
+	}
+}
+
+func TestPragmaNoCacheResponse(t *testing.T) {
+	resetTest()
+	respHeaders := http.Header{}
+	respHeaders.Set("Date", time.Now().Format(time.RFC1123))
+	respHeaders.Set("Expires", time.Now().Add(time.Hour).Format(time.RFC1123))
+	respHeaders.Set("Pragma", "no-cache")
+
+	reqHeaders := http.Header{}
+	if getFreshness(respHeaders, reqHeaders) != stale {
+		t.Fatal("freshness isn't stale")
+	}
+}
+
 func TestNoCacheResponseExpiration(t *testing.T) {
 	resetTest()
 	respHeaders := http.Header{}
@@ -802,6 +859,18 @@ func TestNoCacheResponseExpiration(t *testing.T) {
 	}
 }
 
+func TestQualifiedNoCacheResponseExpiration(t *testing.T) {
+	resetTest()
+	respHeaders := http.Header{}
+	respHeaders.Set("Cache-Control", `no-cache="Set-Cookie", max-age=3600`)
+	respHeaders.Set("Date", time.Now().Format(time.RFC1123))
+
+	reqHeaders := http.Header{}
+	if getFreshness(respHeaders, reqHeaders) != fresh {
+		t.Fatal("freshness isn't fresh")
+	}
+}
+
 func TestReqMustRevalidate(t *testing.T) {
 	resetTest()
 	// not paying attention to request setting max-stale means never returning stale
@@ -844,6 +913,97 @@ func TestFreshExpiration(t *testing.T) {
 	}
 }
 
+func TestHTTPDateFormats(t *testing.T) {
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	for _, value := range []string{
+		"Sun, 06 Nov 1994 08:49:37 GMT",
+		"Sunday, 06-Nov-94 08:49:37 GMT",
+		"Sun Nov  6 08:49:37 1994",
+		"Sun, 06 Nov 1994 08:49:37 +0000",
+		" Sun, 06 Nov 1994 08:49:37 GMT ",
+	} {
+		got, err := ParseHTTPDate(value)
+		if err != nil {
+			t.Errorf("%q: %v", value, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("%q: got %v, want %v", value, got, want)
+		}
+	}
+	if _, err := ParseHTTPDate("0"); err == nil {
+		t.Error(`"0" parsed without error`)
+	}
+}
+
+func TestFreshExpirationRFC850(t *testing.T) {
+	resetTest()
+	now := time.Now().UTC()
+	respHeaders := http.Header{}
+	respHeaders.Set("date", now.Format(time.RFC850))
+	respHeaders.Set("expires", now.Add(time.Duration(2)*time.Minute).Format(time.ANSIC))
+
+	reqHeaders := http.Header{}
+	if getFreshness(respHeaders, reqHeaders) != fresh {
+		t.Fatal("freshness isn't fresh")
+	}
+}
+
+func TestInvalidExpires(t *testing.T) {
+	resetTest()
+	for _, expires := range []string{"0", "-1", "", "tomorrow"} {
+		respHeaders := http.Header{}
+		respHeaders.Set("date", time.Now().Format(time.RFC1123))
+		respHeaders.Set("expires", expires)
+
+		reqHeaders := http.Header{}
+		reqHeaders.Set("cache-control", "max-stale=60")
+		clock = &fakeClock{elapsed: 30 * time.Second}
+		if getFreshness(respHeaders, reqHeaders) != fresh {
+			t.Fatalf("Expires %q: freshness isn't fresh within max-stale of an expired response", expires)
+		}
+		clock = &fakeClock{elapsed: 90 * time.Second}
+		if getFreshness(respHeaders, reqHeaders) != stale {
+			t.Fatalf("Expires %q: freshness isn't stale", expires)
+		}
+	}
+}
+
+func TestMissingDateIsSynthesized(t *testing.T) {
+	resetTest()
+	tmock := transportMock{
+		response: &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=3600"},
+			},
+			Body: ioutil.NopCloser(bytes.NewBuffer([]byte("some data"))),
+		},
+	}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = &tmock
+
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	resp, err := tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Date(resp.Header); err != nil {
+		t.Fatalf("Date header wasn't added: %v", err)
+	}
+
+	tmock.response = nil
+	tmock.err = errors.New("some error")
+	resp, err = tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get(XFromCache) != "1" {
+		t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+	}
+}
+
 func TestMaxAge(t *testing.T) {
 	resetTest()
 	now := time.Now()
@@ -862,6 +1022,35 @@ func TestMaxAge(t *testing.T) {
 	}
 }
 
+func TestMaxAgeInvalid(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	for _, maxAge := range []string{"1.5", "-10", "1e3", "abc"} {
+		respHeaders := http.Header{}
+		respHeaders.Set("date", now.Format(time.RFC1123))
+		respHeaders.Set("cache-control", "max-age="+maxAge)
+
+		reqHeaders := http.Header{}
+		if getFreshness(respHeaders, reqHeaders) != stale {
+			t.Fatalf("max-age=%s: freshness isn't stale", maxAge)
+		}
+	}
+}
+
+func TestMaxAgeOverflow(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	respHeaders := http.Header{}
+	respHeaders.Set("date", now.Format(time.RFC1123))
+	respHeaders.Set("cache-control", "max-age=99999999999")
+
+	reqHeaders := http.Header{}
+	clock = &fakeClock{elapsed: 365 * 24 * time.Hour}
+	if getFreshness(respHeaders, reqHeaders) != fresh {
+		t.Fatal("freshness isn't fresh")
+	}
+}
+
 func TestMaxAgeZero(t *testing.T) {
 	resetTest()
 	now := time.Now()
@@ -954,6 +1143,45 @@ func TestMaxStaleValue(t *testing.T) {
 	}
 }
 
+func TestMaxStaleMustRevalidate(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	for _, directive := range []string{"must-revalidate", "proxy-revalidate"} {
+		respHeaders := http.Header{}
+		respHeaders.Set("date", now.Format(time.RFC1123))
+		respHeaders.Set("cache-control", "max-age=10, "+directive)
+
+		for _, maxStale := range []string{"max-stale", "max-stale=20"} {
+			reqHeaders := http.Header{}
+			reqHeaders.Set("cache-control", maxStale)
+			clock = &fakeClock{elapsed: 5 * time.Second}
+			if getFreshness(respHeaders, reqHeaders) != fresh {
+				t.Fatalf("%s, %s: freshness isn't fresh", directive, maxStale)
+			}
+
+			clock = &fakeClock{elapsed: 15 * time.Second}
+			if getFreshness(respHeaders, reqHeaders) != stale {
+				t.Fatalf("%s, %s: freshness isn't stale", directive, maxStale)
+			}
+		}
+	}
+}
+
+func TestOnlyIfCachedMustRevalidate(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	respHeaders := http.Header{}
+	respHeaders.Set("date", now.Format(time.RFC1123))
+	respHeaders.Set("cache-control", "max-age=10, must-revalidate")
+
+	reqHeaders := http.Header{}
+	reqHeaders.Set("cache-control", "only-if-cached")
+	clock = &fakeClock{elapsed: 15 * time.Second}
+	if getFreshness(respHeaders, reqHeaders) != stale {
+		t.Fatal("freshness isn't stale")
+	}
+}
+
 func containsHeader(headers []string, header string) bool {
 	for _, v := range headers {
 		if http.CanonicalHeaderKey(v) == http.CanonicalHeaderKey(header) {
@@ -1020,6 +1248,32 @@ func (t transportMock) RoundTrip(req *http.Request) (resp *http.Response, err er
 	return t.response, t.err
 }
 
+// roundTripFunc is an http.RoundTripper implemented by a function.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// newResponse returns a response with the given status, headers (as key, value
+// pairs) and body.
+func newResponse(code int, body string, header ...string) *http.Response {
+	h := http.Header{}
+	for i := 0; i+1 < len(header); i += 2 {
+		h.Add(header[i], header[i+1])
+	}
+	return &http.Response{
+		Status:        http.StatusText(code),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
 func TestStaleIfErrorRequest(t *testing.T) {
 	resetTest()
 	now := time.Now()
@@ -1206,3 +1460,753 @@ func TestStaleIfErrorResponseLifetime(t *testing.T) {
 		t.Fatalf("got err %v, want %v", err, tmock.err)
 	}
 }
+
+func TestQualifiedNoCacheResponse(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	tmock := transportMock{
+		response: &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Date":          []string{now.Format(time.RFC1123)},
+				"Cache-Control": []string{`max-age=3600, no-cache="Set-Cookie"`},
+				"Set-Cookie":    []string{"session=abc"},
+			},
+			Body: ioutil.NopCloser(bytes.NewBuffer([]byte("some data"))),
+		},
+	}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = &tmock
+
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	resp, err := tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Set-Cookie") != "session=abc" {
+		t.Fatal("Set-Cookie header was removed from the origin response")
+	}
+
+	// The stored response is fresh and reused without contacting the origin
+	tmock.response = nil
+	tmock.err = errors.New("some error")
+	resp, err = tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get(XFromCache) != "1" {
+		t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+	}
+	if v := resp.Header.Get("Set-Cookie"); v != "" {
+		t.Fatalf("Set-Cookie header was served from the cache: %v", v)
+	}
+}
+
+func TestSharedPrivateFieldNames(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		resetTest()
+		tmock := transportMock{
+			response: &http.Response{
+				Status:     http.StatusText(http.StatusOK),
+				StatusCode: http.StatusOK,
+				Header: http.Header{
+					"Date":          []string{time.Now().Format(time.RFC1123)},
+					"Cache-Control": []string{`max-age=3600, private="X-User"`},
+					"X-User":        []string{"alice"},
+				},
+				Body: ioutil.NopCloser(bytes.NewBuffer([]byte("some data"))),
+			},
+		}
+		tp := NewMemoryCacheTransport()
+		tp.Transport = &tmock
+		tp.Shared = shared
+
+		r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+		resp, err := tp.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.Get("X-User") != "alice" {
+			t.Fatal("X-User header was removed from the origin response")
+		}
+
+		tmock.response = nil
+		tmock.err = errors.New("some error")
+		resp, err = tp.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "alice"
+		if shared {
+			want = ""
+		}
+		if got := resp.Header.Get("X-User"); got != want {
+			t.Fatalf("shared=%v: cached X-User header is %q, want %q", shared, got, want)
+		}
+	}
+}
+
+func TestSharedCanStore(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		auth         bool
+		want         bool
+	}{
+		{"max-age=60", false, true},
+		{"max-age=60, private", false, false},
+		{`max-age=60, private="X-User"`, false, true},
+		{"max-age=60", true, false},
+		{"max-age=60, public", true, true},
+		{"s-maxage=60", true, true},
+		{"max-age=60, must-revalidate", true, true},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+		if test.auth {
+			req.Header.Set("Authorization", "Bearer token")
+		}
+		h := http.Header{}
+		h.Set("Cache-Control", test.cacheControl)
+		if got := sharedCanStore(req, ParseCacheControl(h)); got != test.want {
+			t.Errorf("%q (auth=%v): got %v, want %v", test.cacheControl, test.auth, got, test.want)
+		}
+	}
+}
+
+func TestStaleIfErrorMustRevalidate(t *testing.T) {
+	for _, test := range []struct {
+		respCacheControl string
+		reqCacheControl  string
+	}{
+		{"max-age=10, must-revalidate, stale-if-error=100", ""},
+		{"max-age=10, proxy-revalidate, stale-if-error", ""},
+		{"max-age=10, must-revalidate", "stale-if-error=100"},
+	} {
+		resetTest()
+		tmock := transportMock{
+			response: &http.Response{
+				Status:     http.StatusText(http.StatusOK),
+				StatusCode: http.StatusOK,
+				Header: http.Header{
+					"Date":          []string{time.Now().Format(time.RFC1123)},
+					"Cache-Control": []string{test.respCacheControl},
+				},
+				Body: ioutil.NopCloser(bytes.NewBuffer([]byte("some data"))),
+			},
+		}
+		tp := NewMemoryCacheTransport()
+		tp.Transport = &tmock
+
+		r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+		if test.reqCacheControl != "" {
+			r.Header.Set("Cache-Control", test.reqCacheControl)
+		}
+		if _, err := tp.RoundTrip(r); err != nil {
+			t.Fatal(err)
+		}
+
+		// Once stale, an unreachable origin results in a 504 rather than stale content
+		clock = &fakeClock{elapsed: 20 * time.Second}
+		tmock.response = nil
+		tmock.err = errors.New("some error")
+		resp, err := tp.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Fatalf("%s: response status code isn't 504 Gateway Timeout: %v", test.respCacheControl, resp.StatusCode)
+		}
+
+		// The entry is kept so that it can be revalidated later
+		if _, ok := tp.Cache.Get("http://somewhere.com/"); !ok {
+			t.Fatalf("%s: cached response was deleted", test.respCacheControl)
+		}
+
+		// A request that only accepts cached content gets a 504 as well
+		r2, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+		r2.Header.Set("Cache-Control", "only-if-cached")
+		resp, err = tp.RoundTrip(r2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Fatalf("%s: only-if-cached status code isn't 504 Gateway Timeout: %v", test.respCacheControl, resp.StatusCode)
+		}
+	}
+}
+
+func TestImmutableRoundTrip(t *testing.T) {
+	for _, ignore := range []bool{false, true} {
+		resetTest()
+		tmock := transportMock{
+			response: &http.Response{
+				Status:     http.StatusText(http.StatusOK),
+				StatusCode: http.StatusOK,
+				Header: http.Header{
+					"Date":          []string{time.Now().Format(time.RFC1123)},
+					"Cache-Control": []string{"max-age=3600, immutable"},
+				},
+				Body: ioutil.NopCloser(bytes.NewBuffer([]byte("some data"))),
+			},
+		}
+		tp := NewMemoryCacheTransport()
+		tp.Transport = &tmock
+		tp.IgnoreImmutable = ignore
+
+		r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+		if _, err := tp.RoundTrip(r); err != nil {
+			t.Fatal(err)
+		}
+
+		tmock.response = &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(bytes.NewBuffer([]byte("new data"))),
+		}
+		r.Header.Set("Cache-Control", "no-cache")
+		resp, err := tp.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "1"
+		if ignore {
+			want = ""
+		}
+		if got := resp.Header.Get(XFromCache); got != want {
+			t.Fatalf("IgnoreImmutable=%v: XFromCache header is %q, want %q", ignore, got, want)
+		}
+	}
+}
+
+func TestConditionalRequestFresh(t *testing.T) {
+	resetTest()
+	lm := "Fri, 14 Dec 2010 01:01:50 GMT"
+	tmock := transportMock{
+		response: &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Date":          []string{time.Now().Format(time.RFC1123)},
+				"Cache-Control": []string{"max-age=3600"},
+				"Etag":          []string{`"abc"`},
+				"Last-Modified": []string{lm},
+			},
+			Body: ioutil.NopCloser(bytes.NewBuffer([]byte("some data"))),
+		},
+	}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = &tmock
+
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	if _, err := tp.RoundTrip(r); err != nil {
+		t.Fatal(err)
+	}
+	tmock.response = nil
+	tmock.err = errors.New("some error")
+
+	tests := []struct {
+		header string
+		value  string
+		want   int
+	}{
+		{"If-None-Match", `"abc"`, http.StatusNotModified},
+		{"If-None-Match", `W/"abc"`, http.StatusNotModified},
+		{"If-None-Match", `"xyz", "a,b", "abc"`, http.StatusNotModified},
+		{"If-None-Match", "*", http.StatusNotModified},
+		{"If-None-Match", `"xyz"`, http.StatusOK},
+		{"If-Modified-Since", lm, http.StatusNotModified},
+		{"If-Modified-Since", "Sat, 15 Dec 2010 01:01:50 GMT", http.StatusNotModified},
+		{"If-Modified-Since", "Thu, 13 Dec 2010 01:01:50 GMT", http.StatusOK},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+		r.Header.Set(test.header, test.value)
+		resp, err := tp.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.want {
+			t.Errorf("%s: %s: got status %d, want %d", test.header, test.value, resp.StatusCode, test.want)
+		}
+		if resp.Header.Get(XFromCache) != "1" {
+			t.Errorf(`%s: %s: XFromCache header isn't "1": %v`, test.header, test.value, resp.Header.Get(XFromCache))
+		}
+		if resp.StatusCode == http.StatusNotModified && resp.Header.Get("Etag") != `"abc"` {
+			t.Errorf("%s: %s: 304 response is missing the ETag", test.header, test.value)
+		}
+	}
+}
+
+func TestConditionalRequestStale(t *testing.T) {
+	resetTest()
+	req, err := http.NewRequest("GET", s.server.URL+"/etag", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	{
+		resp, err := s.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	{
+		// The caller's own conditional request gets the origin's 304
+		req2, _ := http.NewRequest("GET", s.server.URL+"/etag", nil)
+		req2.Header.Set("If-None-Match", "124567")
+		resp, err := s.client.Do(req2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotModified {
+			t.Fatalf("response status code isn't 304 Not Modified: %v", resp.StatusCode)
+		}
+		if resp.Header.Get(XFromCache) != "" {
+			t.Fatal("XFromCache header isn't blank")
+		}
+	}
+	{
+		// The stored response is still there to be revalidated by the transport
+		resp, err := s.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("response status code isn't 200 OK: %v", resp.StatusCode)
+		}
+		if resp.Header.Get(XFromCache) != "1" {
+			t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+		}
+	}
+}
+
+func TestNotModifiedFreshensStoredResponse(t *testing.T) {
+	resetTest()
+	var sent []string
+	tp := NewMemoryCacheTransport()
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = append(sent, req.Header.Get("If-None-Match"))
+		if req.Header.Get("If-None-Match") != "" {
+			return newResponse(http.StatusNotModified, "",
+				"Etag", `"a"`, "X-Foo", "2", "Content-Length", "0", "Connection", "close",
+				"Date", time.Now().Format(time.RFC1123)), nil
+		}
+		return newResponse(http.StatusNonAuthoritativeInfo, "some data",
+			"Etag", `"a"`, "X-Foo", "1", "Content-Length", "9",
+			"Date", time.Now().Format(time.RFC1123)), nil
+	})
+
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	if _, err := tp.RoundTrip(r); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNonAuthoritativeInfo {
+		t.Fatalf("response status code isn't 203 Non-Authoritative Information: %v", resp.StatusCode)
+	}
+	if string(body) != "some data" {
+		t.Fatalf("got body %q, want %q", body, "some data")
+	}
+	if got := resp.Header.Get("X-Foo"); got != "2" {
+		t.Fatalf(`X-Foo header isn't "2": %v`, got)
+	}
+	if got := resp.Header.Get("Content-Length"); got != "9" {
+		t.Fatalf(`Content-Length header isn't "9": %v`, got)
+	}
+	if len(sent) != 2 || sent[1] != `"a"` {
+		t.Fatalf("unexpected requests to origin: %q", sent)
+	}
+
+	cached, ok := tp.Cache.Get("http://somewhere.com/")
+	if !ok {
+		t.Fatal("freshened response wasn't stored")
+	}
+	for _, unwanted := range []string{"X-From-Cache", "Connection"} {
+		if bytes.Contains(cached, []byte(unwanted)) {
+			t.Errorf("stored response contains %s", unwanted)
+		}
+	}
+	if !bytes.Contains(cached, []byte("X-Foo: 2")) {
+		t.Error("stored response wasn't updated")
+	}
+}
+
+func TestNotModifiedForDifferentRepresentation(t *testing.T) {
+	resetTest()
+	tp := NewMemoryCacheTransport()
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("If-None-Match") != "" {
+			return newResponse(http.StatusNotModified, "", "Etag", `"b"`), nil
+		}
+		return newResponse(http.StatusOK, "some data", "Etag", `"a"`), nil
+	})
+
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	if _, err := tp.RoundTrip(r); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("response status code isn't 200 OK: %v", resp.StatusCode)
+	}
+	if resp.Header.Get(XFromCache) != "" {
+		t.Fatal("XFromCache header isn't blank")
+	}
+}
+
+func TestCallerNotModifiedFreshensStoredResponse(t *testing.T) {
+	resetTest()
+	requests := 0
+	tp := NewMemoryCacheTransport()
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		if req.Header.Get("If-None-Match") != "" {
+			return newResponse(http.StatusNotModified, "",
+				"Etag", `"a"`, "Cache-Control", "max-age=3600"), nil
+		}
+		return newResponse(http.StatusOK, "some data", "Etag", `"a"`), nil
+	})
+
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	if _, err := tp.RoundTrip(r); err != nil {
+		t.Fatal(err)
+	}
+
+	r2, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	r2.Header.Set("If-None-Match", `"a"`)
+	resp, err := tp.RoundTrip(r2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("response status code isn't 304 Not Modified: %v", resp.StatusCode)
+	}
+
+	// The stored response picked up max-age from the 304 and is now fresh
+	resp, err = tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get(XFromCache) != "1" {
+		t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+	}
+	if requests != 2 {
+		t.Fatalf("got %d requests to origin, want 2", requests)
+	}
+}
+
+func TestCallerNotModifiedHeadKeepsStoredBody(t *testing.T) {
+	resetTest()
+	tp := NewMemoryCacheTransport()
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("If-None-Match") == `"a"` {
+			return newResponse(http.StatusNotModified, "",
+				"Etag", `"a"`, "Cache-Control", "max-age=3600"), nil
+		}
+		return newResponse(http.StatusOK, "hello", "Etag", `"a"`, "Cache-Control", "max-age=0"), nil
+	})
+
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	resp, err := tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	head, _ := http.NewRequest("HEAD", "http://somewhere.com/", nil)
+	head.Header.Set("If-None-Match", `"a"`)
+	resp, err = tp.RoundTrip(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("response status code isn't 304 Not Modified: %v", resp.StatusCode)
+	}
+
+	// The stored response was freshened without losing its body
+	resp, err = tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get(XFromCache) != "1" {
+		t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+	}
+	if string(body) != "hello" {
+		t.Fatalf("got body %q, want %q", body, "hello")
+	}
+}
+
+func TestSelectsForUpdate(t *testing.T) {
+	lm := "Fri, 14 Dec 2010 01:01:50 GMT"
+	tests := []struct {
+		cached        []string
+		notModified   []string
+		ownValidators bool
+		want          bool
+	}{
+		{[]string{"Etag", `"a"`}, []string{"Etag", `"a"`}, false, true},
+		{[]string{"Etag", `"a"`}, []string{"Etag", `"b"`}, true, false},
+		{[]string{"Etag", `W/"a"`}, []string{"Etag", `"a"`}, true, false},
+		{[]string{"Etag", `"a"`}, []string{"Etag", `W/"a"`}, false, true},
+		{[]string{"Etag", `W/"a"`}, []string{"Etag", `W/"a"`}, false, true},
+		{[]string{"Last-Modified", lm}, []string{"Last-Modified", lm}, false, true},
+		{[]string{"Last-Modified", lm}, []string{"Last-Modified", "Sat, 15 Dec 2010 01:01:50 GMT"}, true, false},
+		{[]string{"Etag", `"a"`}, nil, true, true},
+		{[]string{"Etag", `"a"`}, nil, false, false},
+	}
+	for _, test := range tests {
+		cached := newResponse(http.StatusOK, "", test.cached...)
+		notModified := newResponse(http.StatusNotModified, "", test.notModified...)
+		if got := selectsForUpdate(cached, notModified, test.ownValidators); got != test.want {
+			t.Errorf("cached %q, 304 %q, own validators %v: got %v, want %v",
+				test.cached, test.notModified, test.ownValidators, got, test.want)
+		}
+	}
+}
+
+func TestHTTP10Response(t *testing.T) {
+	resetTest()
+	requests := 0
+	tp := NewMemoryCacheTransport()
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		resp := newResponse(http.StatusOK, "some data",
+			"Date", time.Now().UTC().Format(http.TimeFormat),
+			"Expires", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat),
+			"Connection", "keep-alive",
+			"Keep-Alive", "timeout=5")
+		resp.Proto, resp.ProtoMinor = "HTTP/1.0", 0
+		if req.URL.Path == "/vary" {
+			resp.Header.Set("Vary", "Accept")
+		}
+		return resp, nil
+	})
+
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	for i := 0; i < 2; i++ {
+		if _, err := tp.RoundTrip(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("got %d requests to origin, want 1", requests)
+	}
+	stored, _ := tp.Cache.Get("http://somewhere.com/")
+	for _, unwanted := range []string{"Keep-Alive", "keep-alive"} {
+		if bytes.Contains(stored, []byte(unwanted)) {
+			t.Errorf("stored response contains %s:\n%s", unwanted, stored)
+		}
+	}
+
+	// Vary from an HTTP/1.0 server isn't trusted, so the response isn't reused
+	requests = 0
+	r, _ = http.NewRequest("GET", "http://somewhere.com/vary", nil)
+	r.Header.Set("Accept", "text/plain")
+	for i := 0; i < 2; i++ {
+		resp, err := tp.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.Get(XFromCache) != "" {
+			t.Fatal("XFromCache header isn't blank")
+		}
+	}
+	if requests != 2 {
+		t.Fatalf("got %d requests to origin, want 2", requests)
+	}
+}
+
+func TestMemoryCacheExpiry(t *testing.T) {
+	cache := NewMemoryCache()
+	cache.SetWithExpiry("dead", []byte("1"), time.Now().Add(-time.Second))
+	cache.SetWithExpiry("alive", []byte("2"), time.Now().Add(time.Hour))
+	cache.Set("forever", []byte("3"))
+
+	if _, ok := cache.Get("dead"); ok {
+		t.Fatal("expired response was returned")
+	}
+	for _, key := range []string{"alive", "forever"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Fatalf("%q isn't returned", key)
+		}
+	}
+
+	if n := cache.Sweep(); n != 1 {
+		t.Fatalf("Sweep removed %d responses, want 1", n)
+	}
+	if len(cache.items) != 2 {
+		t.Fatalf("got %d responses after Sweep, want 2", len(cache.items))
+	}
+	if n := cache.Sweep(); n != 0 {
+		t.Fatalf("second Sweep removed %d responses, want 0", n)
+	}
+
+	// Set replaces an expiring response with one that never expires
+	cache.SetWithExpiry("dead", []byte("1"), time.Now().Add(-time.Second))
+	cache.Set("dead", []byte("1"))
+	if _, ok := cache.Get("dead"); !ok {
+		t.Fatal("replaced response isn't returned")
+	}
+}
+
+func TestMemoryCacheJanitor(t *testing.T) {
+	cache := NewMemoryCache()
+	stop := cache.StartJanitor(time.Millisecond)
+	defer stop()
+	cache.SetWithExpiry("dead", []byte("1"), time.Now())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cache.mu.RLock()
+		n := len(cache.items)
+		cache.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("janitor didn't remove the expired response")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+}
+
+func TestExpiry(t *testing.T) {
+	resetTest()
+	clock = &fakeClock{elapsed: 10 * time.Second}
+	defer func() { clock = &realClock{} }()
+	date := time.Now().UTC().Format(http.TimeFormat)
+	expires := time.Now().UTC().Add(time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		name  string
+		resp  []string
+		req   []string
+		never bool
+		want  time.Duration
+	}{
+		{name: "etag", resp: []string{"Etag", `"a"`}, never: true},
+		{name: "last-modified", resp: []string{"Last-Modified", date}, never: true},
+		{name: "no date", resp: []string{"Date", ""}, never: true},
+		{name: "no freshness", want: -10 * time.Second},
+		{name: "max-age", resp: []string{"Cache-Control", "max-age=60"}, want: 50 * time.Second},
+		{name: "invalid max-age", resp: []string{"Cache-Control", "max-age=1.5"}, want: -10 * time.Second},
+		{name: "expires", resp: []string{"Expires", expires}, want: time.Hour - 10*time.Second},
+		{name: "no-cache", resp: []string{"Cache-Control", "no-cache, max-age=60"}, want: -10 * time.Second},
+		{name: "stale-if-error", resp: []string{"Cache-Control", "max-age=60, stale-if-error=100"}, want: 150 * time.Second},
+		{name: "bare stale-if-error", resp: []string{"Cache-Control", "stale-if-error"}, never: true},
+		{name: "request stale-if-error", req: []string{"Cache-Control", "stale-if-error=100"}, want: 90 * time.Second},
+		{
+			name: "longest stale-if-error",
+			resp: []string{"Cache-Control", "stale-if-error=20"},
+			req:  []string{"Cache-Control", "stale-if-error=100"},
+			want: 90 * time.Second,
+		},
+		{
+			name: "must-revalidate",
+			resp: []string{"Cache-Control", "max-age=60, stale-if-error, must-revalidate"},
+			want: 50 * time.Second,
+		},
+	}
+	for _, test := range tests {
+		respHeaders := http.Header{"Date": []string{date}}
+		for i := 0; i+1 < len(test.resp); i += 2 {
+			respHeaders.Set(test.resp[i], test.resp[i+1])
+		}
+		reqHeaders := http.Header{}
+		for i := 0; i+1 < len(test.req); i += 2 {
+			reqHeaders.Set(test.req[i], test.req[i+1])
+		}
+		got := expiry(respHeaders, reqHeaders)
+		if got.IsZero() != test.never {
+			t.Errorf("%s: got expiry %v, want never: %v", test.name, got, test.never)
+			continue
+		}
+		if !test.never {
+			if d := time.Until(got) - test.want; d < -2*time.Second || d > 2*time.Second {
+				t.Errorf("%s: expires in %v, want %v", test.name, time.Until(got), test.want)
+			}
+		}
+	}
+}
+
+func TestTransportStoresExpiry(t *testing.T) {
+	resetTest()
+	cache := NewMemoryCache()
+	tp := NewTransport(cache)
+	tp.ExpireDead = true
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/validators" {
+			return newResponse(http.StatusOK, "data", "Etag", `"a"`), nil
+		}
+		return newResponse(http.StatusOK, "data", "Cache-Control", "max-age=60"), nil
+	})
+
+	for _, path := range []string{"/validators", "/fresh"} {
+		r, _ := http.NewRequest("GET", "http://somewhere.com"+path, nil)
+		resp, err := tp.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if e := cache.items["http://somewhere.com/validators"]; !e.expires.IsZero() {
+		t.Fatalf("response with validators expires at %v", e.expires)
+	}
+	e := cache.items["http://somewhere.com/fresh"]
+	if d := time.Until(e.expires); d <= 55*time.Second || d > time.Minute {
+		t.Fatalf("fresh response expires in %v, want about 60s", d)
+	}
+}
+
+func TestTransportKeepsDeadResponses(t *testing.T) {
+	// Without ExpireDead, a response that is dead at once is still there for
+	// only-if-cached and max-stale
+	resetTest()
+	tp := NewMemoryCacheTransport()
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return newResponse(http.StatusOK, "some data"), nil
+	})
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	resp, err := tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+
+	for _, cc := range []string{"only-if-cached", "max-stale"} {
+		r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+		r.Header.Set("Cache-Control", cc)
+		resp, err := tp.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get(XFromCache) != "1" || string(body) != "some data" {
+			t.Fatalf("%s: got status %d, body %q, want the stored response", cc, resp.StatusCode, body)
+		}
+	}
+}
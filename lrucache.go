@@ -0,0 +1,122 @@
+package httpcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRUCache is an implementation of Cache that stores responses in memory up to a
+// maximum total size and/or number of entries, evicting the least recently used
+// responses to make room for new ones.
+type LRUCache struct {
+	// OnEvict, if non-nil, is called with each entry removed to make room for
+	// another. It isn't called for entries removed by Delete or replaced by Set.
+	// It is called without the cache's lock held, so it may use the cache.
+	OnEvict func(key string, resp []byte)
+
+	mu         sync.Mutex
+	maxBytes   int64
+	maxEntries int
+	size       int64
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	resp []byte
+}
+
+// entrySize is the number of bytes an entry accounts for: its key plus its value.
+func entrySize(key string, resp []byte) int64 {
+	return int64(len(key) + len(resp))
+}
+
+// NewLRUCache returns a new LRUCache holding at most maxBytes bytes of keys and
+// values and at most maxEntries entries. A limit of zero means no limit.
+func NewLRUCache(maxBytes int64, maxEntries int) *LRUCache {
+	return &LRUCache{
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+// Get returns the []byte representation of the response and true if present, false if not
+func (c *LRUCache) Get(key string) (resp []byte, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry).resp, true
+}
+
+// Set saves response resp to the cache with key, evicting the least recently used
+// entries as needed. A response too large to fit in the cache on its own isn't stored,
+// and removes any response already stored with key.
+func (c *LRUCache) Set(key string, resp []byte) {
+	c.mu.Lock()
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	if c.maxBytes > 0 && entrySize(key, resp) > c.maxBytes {
+		c.mu.Unlock()
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, resp: resp})
+	c.size += entrySize(key, resp)
+
+	var evicted []*lruEntry
+	for (c.maxBytes > 0 && c.size > c.maxBytes) || (c.maxEntries > 0 && c.ll.Len() > c.maxEntries) {
+		e := c.ll.Back()
+		c.remove(e)
+		evicted = append(evicted, e.Value.(*lruEntry))
+	}
+	c.mu.Unlock()
+
+	if c.OnEvict != nil {
+		for _, entry := range evicted {
+			c.OnEvict(entry.key, entry.resp)
+		}
+	}
+}
+
+// Delete removes key from the cache
+func (c *LRUCache) Delete(key string) {
+	c.mu.Lock()
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	c.mu.Unlock()
+}
+
+// Len returns the number of entries in the cache.
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Size returns the total size in bytes of the keys and values in the cache.
+func (c *LRUCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// remove unlinks e from the cache. c.mu must be held.
+func (c *LRUCache) remove(e *list.Element) {
+	entry := c.ll.Remove(e).(*lruEntry)
+	delete(c.items, entry.key)
+	c.size -= entrySize(entry.key, entry.resp)
+}
+
+// NewLRUCacheTransport returns a new Transport using a bounded in-memory LRUCache,
+// see NewLRUCache.
+func NewLRUCacheTransport(maxBytes int64, maxEntries int) *Transport {
+	return NewTransport(NewLRUCache(maxBytes, maxEntries))
+}
@@ -0,0 +1,155 @@
+package httpcache
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestLRUCache(t *testing.T) {
+	cache := NewLRUCache(0, 0)
+
+	key := "testKey"
+	_, ok := cache.Get(key)
+	if ok {
+		t.Fatal("retrieved key before adding it")
+	}
+
+	val := []byte("some bytes")
+	cache.Set(key, val)
+
+	retVal, ok := cache.Get(key)
+	if !ok {
+		t.Fatal("could not retrieve an element we just added")
+	}
+	if !bytes.Equal(retVal, val) {
+		t.Fatal("retrieved a different value than what we put in")
+	}
+
+	cache.Delete(key)
+
+	_, ok = cache.Get(key)
+	if ok {
+		t.Fatal("deleted key still present")
+	}
+	if cache.Len() != 0 || cache.Size() != 0 {
+		t.Fatalf("empty cache has %d entries of %d bytes", cache.Len(), cache.Size())
+	}
+}
+
+func TestLRUCacheMaxEntries(t *testing.T) {
+	cache := NewLRUCache(0, 2)
+	var evicted []string
+	cache.OnEvict = func(key string, resp []byte) {
+		evicted = append(evicted, key)
+	}
+
+	cache.Set("a", []byte("1"))
+	cache.Set("b", []byte("2"))
+	cache.Get("a") // b is now the least recently used
+	cache.Set("c", []byte("3"))
+
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("least recently used entry wasn't evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Fatalf("%q was evicted", key)
+		}
+	}
+	if !reflect.DeepEqual(evicted, []string{"b"}) {
+		t.Fatalf("got evictions %v, want [b]", evicted)
+	}
+
+	// Explicit deletes and replacements aren't evictions
+	cache.Delete("a")
+	cache.Set("c", []byte("4"))
+	if len(evicted) != 1 {
+		t.Fatalf("got evictions %v, want [b]", evicted)
+	}
+}
+
+func TestLRUCacheMaxBytes(t *testing.T) {
+	cache := NewLRUCache(20, 0)
+	cache.Set("k1", []byte("12345678")) // 10 bytes
+	cache.Set("k2", []byte("12345678")) // 20 bytes
+	if got := cache.Size(); got != 20 {
+		t.Fatalf("got size %d, want 20", got)
+	}
+
+	cache.Set("k3", []byte("1234")) // 26 bytes, so k1 goes
+	if _, ok := cache.Get("k1"); ok {
+		t.Fatal("least recently used entry wasn't evicted")
+	}
+	if got := cache.Size(); got != 16 {
+		t.Fatalf("got size %d, want 16", got)
+	}
+
+	// Replacing a value accounts for the difference in size
+	cache.Set("k3", []byte("12345678"))
+	if got := cache.Size(); got != 20 {
+		t.Fatalf("got size %d, want 20", got)
+	}
+
+	// An entry larger than the cache isn't stored, and replaces any existing value
+	cache.Set("k2", make([]byte, 19))
+	if _, ok := cache.Get("k2"); ok {
+		t.Fatal("oversized entry was stored")
+	}
+	if got, want := cache.Len(), 1; got != want {
+		t.Fatalf("got %d entries, want %d", got, want)
+	}
+	if got := cache.Size(); got != 10 {
+		t.Fatalf("got size %d, want 10", got)
+	}
+}
+
+func TestLRUCacheEvictCallbackCanUseCache(t *testing.T) {
+	cache := NewLRUCache(0, 1)
+	cache.OnEvict = func(key string, resp []byte) {
+		cache.Len()
+	}
+	cache.Set("a", []byte("1"))
+	cache.Set("b", []byte("2"))
+}
+
+func TestLRUCacheConcurrent(t *testing.T) {
+	cache := NewLRUCache(1000, 50)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := strconv.Itoa((i * j) % 97)
+				cache.Set(key, []byte(key))
+				cache.Get(key)
+				if j%10 == 0 {
+					cache.Delete(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if cache.Len() > 50 || cache.Size() > 1000 {
+		t.Fatalf("cache exceeded its limits: %d entries of %d bytes", cache.Len(), cache.Size())
+	}
+}
+
+func TestLRUCacheTransport(t *testing.T) {
+	tp := NewLRUCacheTransport(1<<20, 10)
+	tp.Transport = s.transport.Transport
+	client := tp.Client()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(s.server.URL + "/method")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if i == 1 && resp.Header.Get(XFromCache) != "1" {
+			t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RecentFailureError is returned by Transport, when NegativeTTL is set, for a request
+// that wasn't sent because an earlier request failed recently.
+type RecentFailureError struct {
+	// Scope is the host or cache key the failure was remembered for
+	Scope string
+	// Err is the transport error of the earlier request
+	Err error
+	// Until is when requests will be sent again
+	Until time.Time
+}
+
+func (e *RecentFailureError) Error() string {
+	return fmt.Sprintf("httpcache: not retrying %s until %s after recent failure: %v",
+		e.Scope, e.Until.Format(time.RFC3339), e.Err)
+}
+
+func (e *RecentFailureError) Unwrap() error {
+	return e.Err
+}
+
+type failure struct {
+	err   error
+	until time.Time
+}
+
+// maxFailures is the number of failures remembered at most. When a new one would
+// exceed it, expired ones are pruned, and if none has expired the one that expires
+// first is forgotten, so that failing requests to many URLs can't grow the map
+// without bound.
+const maxFailures = 1024
+
+// send passes req to transport, unless NegativeTTL is set and a request in the same
+// scope failed recently, in which case it returns a *RecentFailureError at once.
+// Transport errors are remembered, except those caused by req's own context being
+// cancelled or timing out.
+func (t *Transport) send(transport http.RoundTripper, req *http.Request, cacheKey string) (*http.Response, error) {
+	if t.NegativeTTL <= 0 {
+		return transport.RoundTrip(req)
+	}
+	scope := cacheKey
+	if t.NegativePerHost {
+		scope = req.URL.Host
+	}
+
+	now := time.Now()
+	t.failMu.Lock()
+	f, ok := t.failures[scope]
+	if ok && now.Before(f.until) {
+		t.failMu.Unlock()
+		return nil, &RecentFailureError{Scope: scope, Err: f.err, Until: f.until}
+	}
+	if ok {
+		delete(t.failures, scope)
+	}
+	t.failMu.Unlock()
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil && req.Context().Err() == nil {
+		t.failMu.Lock()
+		if t.failures == nil {
+			t.failures = map[string]failure{}
+		}
+		if _, ok := t.failures[scope]; !ok && len(t.failures) >= maxFailures {
+			t.pruneFailures(now)
+		}
+		t.failures[scope] = failure{err: err, until: time.Now().Add(t.NegativeTTL)}
+		t.failMu.Unlock()
+	}
+	return resp, err
+}
+
+// pruneFailures makes room for a new failure by forgetting those that have expired by
+// now, or the one that expires first if none has. t.failMu must be held.
+func (t *Transport) pruneFailures(now time.Time) {
+	var first string
+	var firstUntil time.Time
+	for s, f := range t.failures {
+		if !now.Before(f.until) {
+			delete(t.failures, s)
+		} else if first == "" || f.until.Before(firstUntil) {
+			first, firstUntil = s, f.until
+		}
+	}
+	if len(t.failures) >= maxFailures {
+		delete(t.failures, first)
+	}
+}
@@ -0,0 +1,158 @@
+package httpcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	errOrigin := errors.New("connection refused")
+	for _, perHost := range []bool{false, true} {
+		resetTest()
+		calls := 0
+		tp := NewMemoryCacheTransport()
+		tp.NegativeTTL = time.Hour
+		tp.NegativePerHost = perHost
+		tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			return nil, errOrigin
+		})
+
+		r, _ := http.NewRequest("GET", "http://somewhere.com/a", nil)
+		if _, err := tp.RoundTrip(r); err != errOrigin {
+			t.Fatalf("got err %v, want %v", err, errOrigin)
+		}
+		_, err := tp.RoundTrip(r)
+		var recent *RecentFailureError
+		if !errors.As(err, &recent) || !errors.Is(err, errOrigin) {
+			t.Fatalf("got err %v, want a RecentFailureError", err)
+		}
+		if calls != 1 {
+			t.Fatalf("transport was called %d times, want 1", calls)
+		}
+
+		// Other URLs on the host only fail fast if failures are per host
+		r2, _ := http.NewRequest("POST", "http://somewhere.com/b", nil)
+		tp.RoundTrip(r2)
+		if want := map[bool]int{false: 2, true: 1}[perHost]; calls != want {
+			t.Fatalf("perHost %v: transport was called %d times, want %d", perHost, calls, want)
+		}
+
+		// Once the failure expires, requests are sent again
+		tp.failMu.Lock()
+		for scope, f := range tp.failures {
+			f.until = time.Now().Add(-time.Second)
+			tp.failures[scope] = f
+		}
+		tp.failMu.Unlock()
+		calls = 0
+		tp.RoundTrip(r)
+		if calls != 1 {
+			t.Fatalf("perHost %v: transport was called %d times after expiry, want 1", perHost, calls)
+		}
+	}
+}
+
+func TestNegativeCacheLimit(t *testing.T) {
+	resetTest()
+	tp := NewMemoryCacheTransport()
+	tp.NegativeTTL = time.Hour
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+	for i := 0; i < 2*maxFailures; i++ {
+		r, _ := http.NewRequest("GET", fmt.Sprintf("http://somewhere.com/%d", i), nil)
+		tp.RoundTrip(r)
+	}
+	if n := len(tp.failures); n != maxFailures {
+		t.Fatalf("remembered %d failures, want %d", n, maxFailures)
+	}
+
+	// The earliest failures are forgotten first
+	var recent *RecentFailureError
+	first, _ := http.NewRequest("GET", "http://somewhere.com/0", nil)
+	if _, err := tp.RoundTrip(first); errors.As(err, &recent) {
+		t.Fatal("earliest failure wasn't forgotten")
+	}
+	last, _ := http.NewRequest("GET", fmt.Sprintf("http://somewhere.com/%d", 2*maxFailures-1), nil)
+	if _, err := tp.RoundTrip(last); !errors.As(err, &recent) {
+		t.Fatalf("latest failure was forgotten: %v", err)
+	}
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+	resetTest()
+	calls := 0
+	tp := NewMemoryCacheTransport()
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return nil, errors.New("connection refused")
+	})
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	tp.RoundTrip(r)
+	tp.RoundTrip(r)
+	if calls != 2 {
+		t.Fatalf("transport was called %d times, want 2", calls)
+	}
+}
+
+func TestNegativeCacheIgnoresCancellation(t *testing.T) {
+	resetTest()
+	calls := 0
+	tp := NewMemoryCacheTransport()
+	tp.NegativeTTL = time.Hour
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+		return newResponse(http.StatusOK, "some data"), nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	if _, err := tp.RoundTrip(r.WithContext(ctx)); err == nil {
+		t.Fatal("cancelled request succeeded")
+	}
+	if _, err := tp.RoundTrip(r); err != nil {
+		t.Fatalf("request after a cancelled one failed: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("transport was called %d times, want 2", calls)
+	}
+}
+
+func TestNegativeCacheStaleIfError(t *testing.T) {
+	resetTest()
+	calls := 0
+	tp := NewMemoryCacheTransport()
+	tp.NegativeTTL = time.Hour
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		if calls == 1 {
+			return newResponse(http.StatusOK, "some data", "Cache-Control", "no-cache, stale-if-error"), nil
+		}
+		return nil, errors.New("connection refused")
+	})
+
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	for i := 0; i < 3; i++ {
+		resp, err := tp.RoundTrip(r)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != "some data" {
+			t.Fatalf("request %d: got body %q", i, body)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("transport was called %d times, want 2", calls)
+	}
+}
@@ -0,0 +1,85 @@
+package httpcache
+
+import "time"
+
+// ShardedCache is an implementation of Cache that spreads keys over a fixed number of
+// independent shards by hash, so that concurrent requests for different keys rarely
+// contend for the same lock. Each shard is itself a Cache, so a size limit given to
+// the shards (for example by making them LRUCaches) is enforced, and evicts, per shard.
+type ShardedCache struct {
+	shards []Cache
+	mask   uint64
+}
+
+// shardCount rounds n up to a power of two, so that a shard can be picked by masking
+// the key's hash, with a minimum of 1.
+func shardCount(n int) int {
+	count := 1
+	for count < n {
+		count *= 2
+	}
+	return count
+}
+
+// NewShardedCache returns a new ShardedCache with n shards, rounded up to a power of
+// two, each created by calling newShard.
+func NewShardedCache(n int, newShard func() Cache) *ShardedCache {
+	n = shardCount(n)
+	c := &ShardedCache{shards: make([]Cache, n), mask: uint64(n - 1)}
+	for i := range c.shards {
+		c.shards[i] = newShard()
+	}
+	return c
+}
+
+// NewShardedMemoryCache returns a new ShardedCache with n unbounded MemoryCache shards.
+func NewShardedMemoryCache(n int) *ShardedCache {
+	return NewShardedCache(n, func() Cache { return NewMemoryCache() })
+}
+
+// NewShardedLRUCache returns a new ShardedCache with n LRUCache shards, rounded up to
+// a power of two, which share the limits maxBytes and maxEntries equally. Each shard
+// evicts independently, so an entry may be evicted while other shards have room.
+func NewShardedLRUCache(n int, maxBytes int64, maxEntries int) *ShardedCache {
+	n = shardCount(n)
+	shardBytes, shardEntries := maxBytes/int64(n), maxEntries/n
+	if maxBytes > 0 && shardBytes < 1 {
+		shardBytes = 1
+	}
+	if maxEntries > 0 && shardEntries < 1 {
+		shardEntries = 1
+	}
+	return NewShardedCache(n, func() Cache { return NewLRUCache(shardBytes, shardEntries) })
+}
+
+// Shard returns the shard that holds key.
+func (c *ShardedCache) Shard(key string) Cache {
+	return c.shards[hashKey(key)&c.mask]
+}
+
+// Get returns the []byte representation of the response and true if present, false if not
+func (c *ShardedCache) Get(key string) (resp []byte, ok bool) {
+	return c.Shard(key).Get(key)
+}
+
+// Set saves response resp to the cache with key
+func (c *ShardedCache) Set(key string, resp []byte) {
+	c.Shard(key).Set(key, resp)
+}
+
+// GetWithExpiry returns the []byte representation of the response, the time it
+// expires if its shard is an ExpiryGetter, and true if present, false if not
+func (c *ShardedCache) GetWithExpiry(key string) (resp []byte, expires time.Time, ok bool) {
+	return getWithExpiry(c.Shard(key), key)
+}
+
+// SetWithExpiry saves response resp to the cache with key until expires, if its shard
+// is an ExpiringCache, and otherwise indefinitely
+func (c *ShardedCache) SetWithExpiry(key string, resp []byte, expires time.Time) {
+	setWithExpiry(c.Shard(key), key, resp, expires)
+}
+
+// Delete removes key from the cache
+func (c *ShardedCache) Delete(key string) {
+	c.Shard(key).Delete(key)
+}
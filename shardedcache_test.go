@@ -0,0 +1,114 @@
+package httpcache
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedCache(t *testing.T) {
+	cache := NewShardedMemoryCache(8)
+
+	key := "testKey"
+	_, ok := cache.Get(key)
+	if ok {
+		t.Fatal("retrieved key before adding it")
+	}
+
+	val := []byte("some bytes")
+	cache.Set(key, val)
+
+	retVal, ok := cache.Get(key)
+	if !ok {
+		t.Fatal("could not retrieve an element we just added")
+	}
+	if !bytes.Equal(retVal, val) {
+		t.Fatal("retrieved a different value than what we put in")
+	}
+	if _, ok := cache.Shard(key).Get(key); !ok {
+		t.Fatal("key isn't stored in its shard")
+	}
+
+	cache.Delete(key)
+
+	_, ok = cache.Get(key)
+	if ok {
+		t.Fatal("deleted key still present")
+	}
+}
+
+func TestShardCount(t *testing.T) {
+	for n, want := range map[int]int{-1: 1, 0: 1, 1: 1, 3: 4, 16: 16, 17: 32} {
+		if got := len(NewShardedMemoryCache(n).shards); got != want {
+			t.Errorf("%d: got %d shards, want %d", n, got, want)
+		}
+	}
+}
+
+func TestShardedLRUCacheLimits(t *testing.T) {
+	cache := NewShardedLRUCache(4, 4000, 100)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		cache.Set(key, []byte(key))
+	}
+	entries, size := 0, int64(0)
+	for _, shard := range cache.shards {
+		lru := shard.(*LRUCache)
+		if lru.Len() > 25 || lru.Size() > 1000 {
+			t.Fatalf("shard exceeded its limits: %d entries of %d bytes", lru.Len(), lru.Size())
+		}
+		entries += lru.Len()
+		size += lru.Size()
+	}
+	if entries == 0 || entries > 100 || size > 4000 {
+		t.Fatalf("cache holds %d entries of %d bytes", entries, size)
+	}
+
+	// The most recent key is always kept by its shard
+	if _, ok := cache.Get("999"); !ok {
+		t.Fatal("most recently set key was evicted")
+	}
+}
+
+// benchmarkParallel runs a mix of three Gets to each Set against c from parallel
+// goroutines, over a working set of 10,000 keys.
+func benchmarkParallel(b *testing.B, c Cache) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = "http://example.com/" + strconv.Itoa(i)
+		c.Set(keys[i], []byte(keys[i]))
+	}
+	var seed int64
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddInt64(&seed, 7919))
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%4 == 0 {
+				c.Set(key, []byte(key))
+			} else {
+				c.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMemoryCacheParallel(b *testing.B) {
+	benchmarkParallel(b, NewMemoryCache())
+}
+
+func BenchmarkShardedMemoryCacheParallel(b *testing.B) {
+	benchmarkParallel(b, NewShardedMemoryCache(4*runtime.GOMAXPROCS(0)))
+}
+
+func BenchmarkLRUCacheParallel(b *testing.B) {
+	benchmarkParallel(b, NewLRUCache(0, 5000))
+}
+
+func BenchmarkShardedLRUCacheParallel(b *testing.B) {
+	benchmarkParallel(b, NewShardedLRUCache(4*runtime.GOMAXPROCS(0), 0, 5000))
+}
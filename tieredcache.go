@@ -0,0 +1,203 @@
+package httpcache
+
+import (
+	"sync"
+	"time"
+)
+
+// TieredCache is an implementation of Cache that combines an ordered list of caches,
+// fastest first, such as a MemoryCache in front of a diskcache.
+//
+// Get reads through the tiers in order and copies a response found in a slower tier
+// into every faster one, so that it is found sooner next time. Delete removes the
+// response from every tier. Set writes the response to every tier before returning
+// (write-through), or, for a cache made with NewWriteBackTieredCache, to the first
+// tier only, leaving a background goroutine to copy it to the slower tiers
+// (write-back).
+//
+// TieredCache implements ExpiryGetter: SetWithExpiry passes the expiry time on to the
+// tiers that are ExpiringCaches, and a response copied from a slower tier that is an
+// ExpiryGetter keeps its expiry time.
+type TieredCache struct {
+	tiers []Cache
+
+	// Write-back state. pending holds the latest response set for each key that has
+	// yet to reach the slower tiers, in the order given by order, and inflight the
+	// response being written, if writing is set.
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  map[string]tierWrite
+	order    []string
+	inflight tierWrite
+	writing  bool
+	closed   bool
+}
+
+type tierWrite struct {
+	key     string
+	resp    []byte
+	expires time.Time
+}
+
+// NewTieredCache returns a new write-through TieredCache over tiers, which are
+// ordered fastest first.
+func NewTieredCache(tiers ...Cache) *TieredCache {
+	return &TieredCache{tiers: tiers}
+}
+
+// NewWriteBackTieredCache returns a new write-back TieredCache over tiers, which are
+// ordered fastest first. Responses are copied to the slower tiers by a background
+// goroutine, which runs until Close is called; Flush waits for it to catch up.
+func NewWriteBackTieredCache(tiers ...Cache) *TieredCache {
+	c := &TieredCache{tiers: tiers, pending: map[string]tierWrite{}}
+	c.cond = sync.NewCond(&c.mu)
+	go c.writeBack()
+	return c
+}
+
+// Get returns the []byte representation of the response and true if present, false if not
+func (c *TieredCache) Get(key string) (resp []byte, ok bool) {
+	resp, _, ok = c.GetWithExpiry(key)
+	return resp, ok
+}
+
+// GetWithExpiry returns the []byte representation of the response, the time it
+// expires, and true if present, false if not
+func (c *TieredCache) GetWithExpiry(key string) (resp []byte, expires time.Time, ok bool) {
+	for i, tier := range c.tiers {
+		if resp, expires, ok = getWithExpiry(tier, key); ok {
+			for _, faster := range c.tiers[:i] {
+				setWithExpiry(faster, key, resp, expires)
+			}
+			return resp, expires, true
+		}
+		if i == 0 && c.pending != nil {
+			// A write-back response evicted from the first tier may not have
+			// reached the others yet
+			c.mu.Lock()
+			w, ok := c.pending[key]
+			if !ok && c.writing && c.inflight.key == key {
+				w, ok = c.inflight, true
+			}
+			c.mu.Unlock()
+			if ok {
+				setWithExpiry(tier, key, w.resp, w.expires)
+				return w.resp, w.expires, true
+			}
+		}
+	}
+	return nil, time.Time{}, false
+}
+
+// Set saves response resp to the cache with key
+func (c *TieredCache) Set(key string, resp []byte) {
+	c.SetWithExpiry(key, resp, time.Time{})
+}
+
+// SetWithExpiry saves response resp to the cache with key until expires, in the tiers
+// that are ExpiringCaches, and indefinitely in the others
+func (c *TieredCache) SetWithExpiry(key string, resp []byte, expires time.Time) {
+	if len(c.tiers) == 0 {
+		return
+	}
+	if c.pending == nil {
+		for _, tier := range c.tiers {
+			setWithExpiry(tier, key, resp, expires)
+		}
+		return
+	}
+	setWithExpiry(c.tiers[0], key, resp, expires)
+	if len(c.tiers) == 1 {
+		return
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		for _, tier := range c.tiers[1:] {
+			setWithExpiry(tier, key, resp, expires)
+		}
+		return
+	}
+	if _, ok := c.pending[key]; !ok {
+		c.order = append(c.order, key)
+	}
+	c.pending[key] = tierWrite{key, resp, expires}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+// Delete removes key from every tier of the cache
+func (c *TieredCache) Delete(key string) {
+	if c.pending != nil {
+		// Drop any write still to come, and wait for one under way, so that it
+		// can't bring the response back once it's deleted
+		c.mu.Lock()
+		delete(c.pending, key)
+		for c.writing && c.inflight.key == key {
+			c.cond.Wait()
+		}
+		c.mu.Unlock()
+	}
+	for _, tier := range c.tiers {
+		tier.Delete(key)
+	}
+}
+
+// Flush waits until every response set so far has been written to all tiers. It
+// returns at once for a write-through cache.
+func (c *TieredCache) Flush() {
+	if c.pending == nil {
+		return
+	}
+	c.mu.Lock()
+	for len(c.pending) > 0 || c.writing {
+		c.cond.Wait()
+	}
+	c.mu.Unlock()
+}
+
+// Close flushes a write-back cache and stops its background goroutine. Responses set
+// afterwards are written through. Close doesn't close the tiers themselves.
+func (c *TieredCache) Close() {
+	if c.pending == nil {
+		return
+	}
+	c.Flush()
+	c.mu.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+// writeBack copies pending responses to the slower tiers, oldest first, until the
+// cache is closed.
+func (c *TieredCache) writeBack() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for len(c.order) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if len(c.order) == 0 {
+			return
+		}
+		key := c.order[0]
+		c.order = c.order[1:]
+		w, ok := c.pending[key]
+		if !ok {
+			// Deleted before it was written
+			continue
+		}
+		delete(c.pending, key)
+		c.inflight, c.writing = w, true
+		c.mu.Unlock()
+
+		for _, tier := range c.tiers[1:] {
+			setWithExpiry(tier, key, w.resp, w.expires)
+		}
+
+		c.mu.Lock()
+		c.inflight, c.writing = tierWrite{}, false
+		c.cond.Broadcast()
+	}
+}
@@ -0,0 +1,200 @@
+package httpcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gregjones/httpcache/diskcache"
+	"github.com/gregjones/httpcache/leveldbcache"
+)
+
+// slowTiers returns a diskcache and a leveldbcache in a temporary directory, to be
+// used as the slower tiers of a TieredCache, and a function that removes them.
+func slowTiers(t *testing.T) (map[string]Cache, func()) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	db, err := leveldbcache.New(filepath.Join(tempDir, "db"))
+	if err != nil {
+		os.RemoveAll(tempDir)
+		t.Fatalf("New leveldb: %v", err)
+	}
+	tiers := map[string]Cache{
+		"diskcache":    diskcache.New(filepath.Join(tempDir, "disk")),
+		"leveldbcache": db,
+	}
+	return tiers, func() { os.RemoveAll(tempDir) }
+}
+
+func TestTieredCache(t *testing.T) {
+	tiers, cleanup := slowTiers(t)
+	defer cleanup()
+	for name, slow := range tiers {
+		for _, writeBack := range []bool{false, true} {
+			fast := NewMemoryCache()
+			var cache *TieredCache
+			if writeBack {
+				cache = NewWriteBackTieredCache(fast, slow)
+			} else {
+				cache = NewTieredCache(fast, slow)
+			}
+
+			key := "testKey"
+			if _, ok := cache.Get(key); ok {
+				t.Fatalf("%s: retrieved key before adding it", name)
+			}
+
+			val := []byte("some bytes")
+			cache.Set(key, val)
+			cache.Flush()
+			for i, tier := range []Cache{fast, slow} {
+				if retVal, ok := tier.Get(key); !ok || !bytes.Equal(retVal, val) {
+					t.Fatalf("%s: tier %d doesn't hold the value", name, i)
+				}
+			}
+
+			// A hit in the slow tier is promoted to the fast one
+			fast.Delete(key)
+			retVal, ok := cache.Get(key)
+			if !ok || !bytes.Equal(retVal, val) {
+				t.Fatalf("%s: value isn't read through from the slow tier", name)
+			}
+			if _, ok := fast.Get(key); !ok {
+				t.Fatalf("%s: value wasn't promoted to the fast tier", name)
+			}
+
+			cache.Delete(key)
+			for i, tier := range []Cache{fast, slow} {
+				if _, ok := tier.Get(key); ok {
+					t.Fatalf("%s: deleted key still present in tier %d", name, i)
+				}
+			}
+			cache.Close()
+		}
+	}
+}
+
+// gatedCache is a MemoryCache whose Set blocks until a value is sent on gate.
+type gatedCache struct {
+	*MemoryCache
+	gate chan struct{}
+}
+
+func (c *gatedCache) Set(key string, resp []byte) {
+	c.SetWithExpiry(key, resp, time.Time{})
+}
+
+func (c *gatedCache) SetWithExpiry(key string, resp []byte, expires time.Time) {
+	<-c.gate
+	c.MemoryCache.SetWithExpiry(key, resp, expires)
+}
+
+func TestWriteBackTieredCache(t *testing.T) {
+	fast := NewMemoryCache()
+	slow := &gatedCache{MemoryCache: NewMemoryCache(), gate: make(chan struct{})}
+	cache := NewWriteBackTieredCache(fast, slow)
+
+	// Set returns before the slow tier is written, and the pending value is still
+	// served if the fast tier loses it
+	cache.Set("a", []byte("1"))
+	fast.Delete("a")
+	if retVal, ok := cache.Get("a"); !ok || string(retVal) != "1" {
+		t.Fatal("pending value isn't returned")
+	}
+	if _, ok := slow.MemoryCache.Get("a"); ok {
+		t.Fatal("slow tier was written synchronously")
+	}
+
+	// A pending value that is deleted is never written
+	cache.Set("b", []byte("2"))
+	cache.Delete("b")
+	slow.gate <- struct{}{} // a
+	cache.Flush()
+	if _, ok := slow.MemoryCache.Get("a"); !ok {
+		t.Fatal("slow tier wasn't written back")
+	}
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("deleted value was written back")
+	}
+
+	// Once closed, writes go through
+	cache.Close()
+	go func() { slow.gate <- struct{}{} }()
+	cache.Set("c", []byte("3"))
+	if _, ok := slow.MemoryCache.Get("c"); !ok {
+		t.Fatal("closed cache didn't write through")
+	}
+}
+
+func TestTieredCacheTransport(t *testing.T) {
+	tiers, cleanup := slowTiers(t)
+	defer cleanup()
+	tp := NewTransport(NewTieredCache(NewMemoryCache(), tiers["diskcache"]))
+	tp.Transport = s.transport.Transport
+	client := tp.Client()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(s.server.URL + "/method")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if i == 1 && resp.Header.Get(XFromCache) != "1" {
+			t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+		}
+	}
+}
+
+func TestTieredCacheExpiry(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	disk, err := diskcache.NewWithOptions(tempDir, diskcache.Options{})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	defer disk.Close()
+	for _, writeBack := range []bool{false, true} {
+		fast := NewMemoryCache()
+		var cache *TieredCache
+		if writeBack {
+			cache = NewWriteBackTieredCache(fast, disk)
+		} else {
+			cache = NewTieredCache(fast, disk)
+		}
+		var _ ExpiryGetter = cache
+
+		expires := time.Now().Add(time.Hour).Round(0)
+		cache.SetWithExpiry("key", []byte("some bytes"), expires)
+		cache.Flush()
+		if _, got, _ := fast.GetWithExpiry("key"); !got.Equal(expires) {
+			t.Fatalf("write-back %v: fast tier expires at %v, want %v", writeBack, got, expires)
+		}
+
+		// A promoted response keeps its expiry time
+		fast.Delete("key")
+		if _, got, ok := cache.GetWithExpiry("key"); !ok {
+			t.Fatalf("write-back %v: response isn't read through", writeBack)
+		} else if _, fastGot, _ := fast.GetWithExpiry("key"); !fastGot.Equal(got) {
+			t.Fatalf("write-back %v: promoted response expires at %v, want %v", writeBack, fastGot, got)
+		}
+
+		// Dead responses written through the tiers are swept from each
+		cache.SetWithExpiry("dead", []byte("1"), time.Now().Add(-time.Second))
+		cache.Flush()
+		if n := fast.Sweep(); n != 1 {
+			t.Fatalf("write-back %v: Sweep removed %d responses, want 1", writeBack, n)
+		}
+		if n := disk.GC(); n != 1 {
+			t.Fatalf("write-back %v: GC removed %d responses, want 1", writeBack, n)
+		}
+		cache.Delete("key")
+		cache.Close()
+	}
+}
@@ -0,0 +1,59 @@
+package httpcache_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gregjones/httpcache"
+	"github.com/gregjones/httpcache/compresscache"
+	"github.com/gregjones/httpcache/encryptcache"
+)
+
+// TestTieredCacheWrappedExpiry checks that expiry times pass through the cache wrappers
+// in the slower tier of a TieredCache, both when a response is set and when it is
+// copied to the faster tier.
+func TestTieredCacheWrappedExpiry(t *testing.T) {
+	compressed, err := compresscache.New(httpcache.NewMemoryCache(), compresscache.NewGzipCodec(gzip.DefaultCompression))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := encryptcache.New(httpcache.NewMemoryCache(), encryptcache.Key{ID: 1, Secret: bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrappers := map[string]httpcache.ExpiryGetter{
+		"ChecksumCache": httpcache.NewChecksumCache(httpcache.NewMemoryCache()),
+		"DedupCache":    httpcache.NewDedupCache(httpcache.NewMemoryCache()),
+		"compresscache": compressed,
+		"encryptcache":  encrypted,
+	}
+	resp := []byte("HTTP/1.1 200 OK\r\n\r\n" + strings.Repeat("some bytes", 100))
+	for name, slow := range wrappers {
+		fast := httpcache.NewMemoryCache()
+		cache := httpcache.NewTieredCache(fast, slow)
+		expires := time.Now().Add(time.Hour).Round(0)
+
+		cache.SetWithExpiry("key", resp, expires)
+		if got, gotExpires, ok := slow.GetWithExpiry("key"); !ok || !bytes.Equal(got, resp) {
+			t.Fatalf("%s: response isn't stored", name)
+		} else if !gotExpires.Equal(expires) {
+			t.Fatalf("%s: stored response expires at %v, want %v", name, gotExpires, expires)
+		}
+		cache.SetWithExpiry("dead", resp, time.Now().Add(-time.Second))
+		if _, ok := slow.Get("dead"); ok {
+			t.Fatalf("%s: dead response is returned", name)
+		}
+
+		// A response copied from the wrapped tier keeps its expiry time
+		fast.Delete("key")
+		if got, ok := cache.Get("key"); !ok || !bytes.Equal(got, resp) {
+			t.Fatalf("%s: response isn't read through", name)
+		}
+		if _, gotExpires, _ := fast.GetWithExpiry("key"); !gotExpires.Equal(expires) {
+			t.Fatalf("%s: promoted response expires at %v, want %v", name, gotExpires, expires)
+		}
+	}
+}
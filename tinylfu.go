@@ -0,0 +1,310 @@
+package httpcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// TinyLFUCache is an implementation of Cache that, like LRUCache, holds responses in
+// memory up to a maximum total size and/or number of entries, but uses the W-TinyLFU
+// policy to decide what to keep. New entries go into a small LRU window; when they
+// leave it they are only admitted to the main cache if they have been used more often
+// than the entry they would displace, according to a compact frequency sketch. This
+// keeps frequently used responses cached while a scan of one-off URLs passes through.
+//
+// See "TinyLFU: A Highly Efficient Cache Admission Policy" (Einziger, Friedman and
+// Manes) for a description of the policy.
+type TinyLFUCache struct {
+	// OnEvict, if non-nil, is called with each entry removed to make room for
+	// another, including new entries that weren't admitted to the main cache. It
+	// isn't called for entries removed by Delete or replaced by Set.
+	OnEvict func(key string, resp []byte)
+
+	mu         sync.Mutex
+	maxBytes   int64
+	maxEntries int
+	window     segment
+	probation  segment
+	protected  segment
+	items      map[string]*list.Element
+	sketch     *countMinSketch
+	evicted    []*tinyLFUEntry
+}
+
+type tinyLFUEntry struct {
+	key  string
+	resp []byte
+	hash uint64
+	seg  *segment
+}
+
+// segment is an LRU list of entries with its own capacity.
+type segment struct {
+	ll         list.List
+	size       int64
+	maxBytes   int64
+	maxEntries int
+}
+
+func (s *segment) over() bool {
+	return (s.maxBytes > 0 && s.size > s.maxBytes) || (s.maxEntries > 0 && s.ll.Len() > s.maxEntries)
+}
+
+func (s *segment) pushFront(entry *tinyLFUEntry) *list.Element {
+	entry.seg = s
+	s.size += entrySize(entry.key, entry.resp)
+	return s.ll.PushFront(entry)
+}
+
+func (s *segment) remove(e *list.Element) *tinyLFUEntry {
+	entry := s.ll.Remove(e).(*tinyLFUEntry)
+	s.size -= entrySize(entry.key, entry.resp)
+	return entry
+}
+
+// NewTinyLFUCache returns a new TinyLFUCache holding at most maxBytes bytes of keys
+// and values and at most maxEntries entries. A limit of zero means no limit; with no
+// limits at all nothing is ever evicted.
+func NewTinyLFUCache(maxBytes int64, maxEntries int) *TinyLFUCache {
+	c := &TinyLFUCache{
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		items:      map[string]*list.Element{},
+	}
+	// The window gets 1% of the capacity and the main cache the rest, of which 80% is
+	// protected, as recommended in the paper.
+	split := func(bytes int64, entries int, percent int) (int64, int) {
+		b := bytes * int64(percent) / 100
+		if bytes > 0 && b < 1 {
+			b = 1
+		}
+		e := entries * percent / 100
+		if entries > 0 && e < 1 {
+			e = 1
+		}
+		return b, e
+	}
+	c.window.maxBytes, c.window.maxEntries = split(maxBytes, maxEntries, 1)
+	c.protected.maxBytes, c.protected.maxEntries = split(maxBytes, maxEntries, 79)
+
+	// Size the sketch for the expected number of entries, guessing 4KB per
+	// response when only a byte limit is given.
+	expected := maxEntries
+	if expected == 0 {
+		expected = int(maxBytes / 4096)
+	}
+	c.sketch = newCountMinSketch(expected)
+	return c
+}
+
+// Get returns the []byte representation of the response and true if present, false if not
+func (c *TinyLFUCache) Get(key string) (resp []byte, ok bool) {
+	h := hashKey(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sketch.increment(h)
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.touch(e)
+	return e.Value.(*tinyLFUEntry).resp, true
+}
+
+// Set saves response resp to the cache with key, evicting entries as needed. A
+// response too large to fit in the cache on its own isn't stored, and removes any
+// response already stored with key.
+func (c *TinyLFUCache) Set(key string, resp []byte) {
+	h := hashKey(key)
+	c.mu.Lock()
+	c.sketch.increment(h)
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*tinyLFUEntry)
+		seg := entry.seg
+		seg.remove(e)
+		delete(c.items, key)
+		if c.maxBytes > 0 && entrySize(key, resp) > c.maxBytes {
+			c.mu.Unlock()
+			return
+		}
+		entry.resp = resp
+		c.items[key] = seg.pushFront(entry)
+	} else {
+		if c.maxBytes > 0 && entrySize(key, resp) > c.maxBytes {
+			c.mu.Unlock()
+			return
+		}
+		c.items[key] = c.window.pushFront(&tinyLFUEntry{key: key, resp: resp, hash: h})
+	}
+	c.rebalance()
+	evicted := c.evicted
+	c.evicted = nil
+	c.mu.Unlock()
+
+	if c.OnEvict != nil {
+		for _, entry := range evicted {
+			c.OnEvict(entry.key, entry.resp)
+		}
+	}
+}
+
+// Delete removes key from the cache
+func (c *TinyLFUCache) Delete(key string) {
+	c.mu.Lock()
+	if e, ok := c.items[key]; ok {
+		e.Value.(*tinyLFUEntry).seg.remove(e)
+		delete(c.items, key)
+	}
+	c.mu.Unlock()
+}
+
+// Len returns the number of entries in the cache.
+func (c *TinyLFUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// Size returns the total size in bytes of the keys and values in the cache.
+func (c *TinyLFUCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.window.size + c.probation.size + c.protected.size
+}
+
+// touch records a hit on e: window and protected entries move to the front of their
+// segment, and probation entries are promoted to protected. c.mu must be held.
+func (c *TinyLFUCache) touch(e *list.Element) {
+	entry := e.Value.(*tinyLFUEntry)
+	if entry.seg != &c.probation {
+		entry.seg.ll.MoveToFront(e)
+		return
+	}
+	c.probation.remove(e)
+	c.items[entry.key] = c.protected.pushFront(entry)
+	for c.protected.over() {
+		demoted := c.protected.remove(c.protected.ll.Back())
+		c.items[demoted.key] = c.probation.pushFront(demoted)
+	}
+}
+
+// mainOver reports whether the probation and protected segments together exceed the
+// capacity left over by the window.
+func (c *TinyLFUCache) mainOver() bool {
+	size := c.probation.size + c.protected.size
+	n := c.probation.ll.Len() + c.protected.ll.Len()
+	return (c.maxBytes > 0 && size > c.maxBytes-c.window.maxBytes) ||
+		(c.maxEntries > 0 && n > c.maxEntries-c.window.maxEntries)
+}
+
+// rebalance moves entries that overflow the window into the main cache, where each
+// competes with the main cache's eviction victims for admission. c.mu must be held.
+func (c *TinyLFUCache) rebalance() {
+	for c.protected.over() {
+		demoted := c.protected.remove(c.protected.ll.Back())
+		c.items[demoted.key] = c.probation.pushFront(demoted)
+	}
+	for c.window.over() {
+		candidate := c.window.remove(c.window.ll.Back())
+		c.items[candidate.key] = c.probation.pushFront(candidate)
+		for c.mainOver() {
+			victim := c.victim(candidate)
+			if victim != candidate && c.sketch.estimate(candidate.hash) <= c.sketch.estimate(victim.hash) {
+				// The candidate is no more popular than the victim, so it's rejected
+				victim = candidate
+			}
+			c.evict(victim)
+			if victim == candidate {
+				break
+			}
+		}
+	}
+	// Entries already in the main cache may have grown
+	for c.mainOver() {
+		c.evict(c.victim(nil))
+	}
+}
+
+// victim returns the main cache entry to evict next: the least recently used in
+// probation other than candidate, or failing that in protected, or candidate itself.
+// c.mu must be held.
+func (c *TinyLFUCache) victim(candidate *tinyLFUEntry) *tinyLFUEntry {
+	if e := c.probation.ll.Back(); e != nil && e.Value.(*tinyLFUEntry) != candidate {
+		return e.Value.(*tinyLFUEntry)
+	}
+	if e := c.protected.ll.Back(); e != nil {
+		return e.Value.(*tinyLFUEntry)
+	}
+	return candidate
+}
+
+// evict removes entry from the cache and queues it for OnEvict. c.mu must be held.
+func (c *TinyLFUCache) evict(entry *tinyLFUEntry) {
+	entry.seg.remove(c.items[entry.key])
+	delete(c.items, entry.key)
+	c.evicted = append(c.evicted, entry)
+}
+
+// hashKey returns the 64-bit FNV-1a hash of key, computed inline to avoid allocating.
+func hashKey(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// countMinSketch estimates how often keys have been seen, using four rows of
+// saturating 4-bit counters. Counters are halved periodically so that the estimates
+// favour recent popularity.
+type countMinSketch struct {
+	rows      [4][]uint8
+	mask      uint32
+	additions int
+	resetAt   int
+}
+
+func newCountMinSketch(expected int) *countMinSketch {
+	width := 256
+	for width < expected {
+		width *= 2
+	}
+	s := &countMinSketch{mask: uint32(width - 1), resetAt: 10 * width}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) index(h uint64, row int) uint32 {
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	return (h1 + uint32(row)*h2) & s.mask
+}
+
+func (s *countMinSketch) increment(h uint64) {
+	for i := range s.rows {
+		if c := &s.rows[i][s.index(h, i)]; *c < 15 {
+			*c++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] /= 2
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *countMinSketch) estimate(h uint64) uint8 {
+	min := uint8(15)
+	for i := range s.rows {
+		if c := s.rows[i][s.index(h, i)]; c < min {
+			min = c
+		}
+	}
+	return min
+}
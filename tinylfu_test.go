@@ -0,0 +1,230 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var traceFile = flag.String("trace", "", "file of recorded cache keys, one per line, to replay in BenchmarkHitRatio")
+
+func TestTinyLFUCache(t *testing.T) {
+	cache := NewTinyLFUCache(0, 100)
+
+	key := "testKey"
+	_, ok := cache.Get(key)
+	if ok {
+		t.Fatal("retrieved key before adding it")
+	}
+
+	val := []byte("some bytes")
+	cache.Set(key, val)
+
+	retVal, ok := cache.Get(key)
+	if !ok {
+		t.Fatal("could not retrieve an element we just added")
+	}
+	if !bytes.Equal(retVal, val) {
+		t.Fatal("retrieved a different value than what we put in")
+	}
+
+	cache.Delete(key)
+
+	_, ok = cache.Get(key)
+	if ok {
+		t.Fatal("deleted key still present")
+	}
+	if cache.Len() != 0 || cache.Size() != 0 {
+		t.Fatalf("empty cache has %d entries of %d bytes", cache.Len(), cache.Size())
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	h := fnv.New64a()
+	h.Write([]byte("http://example.com/"))
+	if got, want := hashKey("http://example.com/"), h.Sum64(); got != want {
+		t.Fatalf("got %x, want FNV-1a %x", got, want)
+	}
+}
+
+func TestTinyLFUCacheLimits(t *testing.T) {
+	for _, limits := range []struct {
+		maxBytes   int64
+		maxEntries int
+	}{{0, 1}, {0, 10}, {0, 1000}, {64, 0}, {1 << 14, 0}, {1 << 14, 50}} {
+		cache := NewTinyLFUCache(limits.maxBytes, limits.maxEntries)
+		evictions := 0
+		cache.OnEvict = func(key string, resp []byte) { evictions++ }
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 10000; i++ {
+			key := strconv.Itoa(r.Intn(3000))
+			if _, ok := cache.Get(key); !ok {
+				cache.Set(key, make([]byte, r.Intn(40)))
+			}
+			if limits.maxEntries > 0 && cache.Len() > limits.maxEntries {
+				t.Fatalf("%+v: cache has %d entries", limits, cache.Len())
+			}
+			if limits.maxBytes > 0 && cache.Size() > limits.maxBytes {
+				t.Fatalf("%+v: cache has %d bytes", limits, cache.Size())
+			}
+		}
+		if evictions == 0 {
+			t.Fatalf("%+v: nothing was evicted", limits)
+		}
+
+		var size int64
+		for _, seg := range []*segment{&cache.window, &cache.probation, &cache.protected} {
+			for e := seg.ll.Front(); e != nil; e = e.Next() {
+				entry := e.Value.(*tinyLFUEntry)
+				if entry.seg != seg || cache.items[entry.key] != e {
+					t.Fatalf("%+v: entry %q is misplaced", limits, entry.key)
+				}
+				size += entrySize(entry.key, entry.resp)
+			}
+		}
+		if size != cache.Size() {
+			t.Fatalf("%+v: entries add up to %d bytes, cache reports %d", limits, size, cache.Size())
+		}
+	}
+}
+
+func TestTinyLFUCacheOversizedEntry(t *testing.T) {
+	cache := NewTinyLFUCache(20, 0)
+	cache.Set("k1", []byte("12345678"))
+	cache.Set("k1", make([]byte, 19))
+	if _, ok := cache.Get("k1"); ok {
+		t.Fatal("oversized entry was stored")
+	}
+	if cache.Len() != 0 || cache.Size() != 0 {
+		t.Fatalf("cache has %d entries of %d bytes", cache.Len(), cache.Size())
+	}
+}
+
+// TestTinyLFUCacheScanResistance checks that a stream of one-off keys doesn't flush
+// frequently used keys out of a TinyLFUCache the way it does an LRUCache.
+func TestTinyLFUCacheScanResistance(t *testing.T) {
+	trace := scanTrace(50000)
+	lru := hitRatio(NewLRUCache(0, 1000), trace)
+	tinyLFU := hitRatio(NewTinyLFUCache(0, 1000), trace)
+	if tinyLFU <= lru {
+		t.Fatalf("TinyLFU hit ratio %.3f isn't better than LRU %.3f", tinyLFU, lru)
+	}
+}
+
+// zipfTrace returns n keys drawn from a Zipf distribution over 100,000 URLs.
+func zipfTrace(n int) []string {
+	r := rand.New(rand.NewSource(1))
+	z := rand.NewZipf(r, 1.1, 1, 100000)
+	trace := make([]string, n)
+	for i := range trace {
+		trace[i] = fmt.Sprintf("http://api.example.com/item/%d", z.Uint64())
+	}
+	return trace
+}
+
+// scanTrace returns n keys modelling a crawler: hot API URLs drawn from a Zipf
+// distribution, interleaved with long runs of URLs that are only fetched once.
+func scanTrace(n int) []string {
+	r := rand.New(rand.NewSource(1))
+	z := rand.NewZipf(r, 1.1, 1, 5000)
+	trace := make([]string, 0, n)
+	crawled := 0
+	for len(trace) < n {
+		for i := 0; i < 2000 && len(trace) < n; i++ {
+			trace = append(trace, fmt.Sprintf("http://api.example.com/item/%d", z.Uint64()))
+		}
+		for i := 0; i < 3000 && len(trace) < n; i++ {
+			trace = append(trace, fmt.Sprintf("http://crawl.example.com/page/%d", crawled))
+			crawled++
+		}
+	}
+	return trace
+}
+
+// loadTrace reads recorded keys from path, taking the first field of each line.
+func loadTrace(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var trace []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if fields := strings.Fields(sc.Text()); len(fields) > 0 {
+			trace = append(trace, fields[0])
+		}
+	}
+	return trace, sc.Err()
+}
+
+// hitRatio replays trace against c, storing each key that misses.
+func hitRatio(c Cache, trace []string) float64 {
+	hits := 0
+	resp := make([]byte, 100)
+	for _, key := range trace {
+		if _, ok := c.Get(key); ok {
+			hits++
+		} else {
+			c.Set(key, resp)
+		}
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+// BenchmarkHitRatio compares LRUCache and TinyLFUCache on synthetic traces and, with
+// -trace, on a recorded one. Besides ns/op it reports the hit ratio as hit%.
+func BenchmarkHitRatio(b *testing.B) {
+	traces := []struct {
+		name  string
+		trace []string
+	}{
+		{"zipf", zipfTrace(500000)},
+		{"scan", scanTrace(500000)},
+	}
+	if *traceFile != "" {
+		trace, err := loadTrace(*traceFile)
+		if err != nil {
+			b.Fatal(err)
+		}
+		traces = append(traces, struct {
+			name  string
+			trace []string
+		}{"recorded", trace})
+	}
+	policies := []struct {
+		name string
+		new  func(maxEntries int) Cache
+	}{
+		{"LRU", func(n int) Cache { return NewLRUCache(0, n) }},
+		{"TinyLFU", func(n int) Cache { return NewTinyLFUCache(0, n) }},
+	}
+	for _, tr := range traces {
+		for _, size := range []int{1000, 10000} {
+			for _, policy := range policies {
+				b.Run(fmt.Sprintf("trace=%s/size=%d/policy=%s", tr.name, size, policy.name), func(b *testing.B) {
+					c := policy.new(size)
+					resp := make([]byte, 100)
+					hits := 0
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						key := tr.trace[i%len(tr.trace)]
+						if _, ok := c.Get(key); ok {
+							hits++
+						} else {
+							c.Set(key, resp)
+						}
+					}
+					b.ReportMetric(100*float64(hits)/float64(b.N), "hit%")
+				})
+			}
+		}
+	}
+}